@@ -0,0 +1,77 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Affected returns the names of the apps whose context, Dockerfile or watched
+// paths changed since the git revision, along with the apps that want them,
+// in the order of the configuration.
+func Affected(config Config, revision string) ([]string, error) {
+	apps, err := config.GetApps()
+	if err != nil {
+		return nil, configError(err)
+	}
+
+	files, root, err := changedFiles(revision)
+	if err != nil {
+		pError("Could not diff against %s: %s", revision, err)
+		return nil, StatusError{err, NoGit}
+	}
+
+	affected := make(map[string]bool)
+	for _, app := range apps {
+		for _, file := range files {
+			if appDependsOn(config, app, filepath.Join(root, filepath.FromSlash(file))) {
+				pDebug("%s changed since %s, affecting %s", file, revision, app.Name)
+				affected[app.Name] = true
+				break
+			}
+		}
+	}
+
+	// Apps are ordered by dependency, so the apps they want are already known
+	var names []string
+	for _, app := range apps {
+		for _, want := range app.Wants {
+			if affected[want] {
+				affected[app.Name] = true
+			}
+		}
+		if affected[app.Name] {
+			names = append(names, app.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		pInfo("No app changed since %s", revision)
+	} else {
+		pInfo("Apps changed since %s: %s", revision, strings.Join(names, ", "))
+	}
+	return names, nil
+}
+
+// appDependsOn reports whether the file is part of the context, the
+// Dockerfile or the watched paths of the app.
+func appDependsOn(config Config, app App, file string) bool {
+	base, err := filepath.Abs(config.GetPath())
+	if err != nil {
+		return false
+	}
+
+	paths := []string{
+		filepath.Join(base, app.Context),
+		filepath.Join(base, app.Context, app.Build),
+	}
+	for _, watch := range app.Watch {
+		paths = append(paths, filepath.Join(base, watch))
+	}
+
+	for _, path := range paths {
+		if file == path || strings.HasPrefix(file, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitFiles writes the files to the worktree and commits them
+func commitFiles(t *testing.T, w *git.Worktree, files map[string]string) plumbing.Hash {
+	for name, content := range files {
+		writeFile(t, filepath.Join(w.Filesystem.Root(), name), content)
+		_, err := w.Add(name)
+		assert.NoError(t, err)
+	}
+	h, err := w.Commit("commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "captain", Email: "captain@harbur.io", When: time.Now()},
+	})
+	assert.NoError(t, err)
+	return h
+}
+
+func writeFile(t *testing.T, name, content string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	assert.NoError(t, ioutil.WriteFile(name, []byte(content), 0644))
+}
+
+func TestAffected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "captain")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	r, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	w, err := r.Worktree()
+	assert.NoError(t, err)
+
+	first := commitFiles(t, w, map[string]string{
+		"captain.yml": `
+web:
+  context: web
+  image: harbur/web
+  watch: [shared]
+backend:
+  context: backend
+  image: harbur/backend
+e2e:
+  context: e2e
+  image: harbur/e2e
+  wants: [web]
+`,
+		"web/Dockerfile":     "FROM scratch",
+		"backend/Dockerfile": "FROM scratch",
+		"e2e/Dockerfile":     "FROM scratch",
+		"shared/lib":         "v1",
+		"README.md":          "v1",
+	})
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	assert.NoError(t, os.Chdir(dir))
+
+	config, err := NewConfig("", "captain.yml", true, false)
+	assert.NoError(t, err)
+
+	names, err := Affected(config, first.String())
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+
+	commitFiles(t, w, map[string]string{"shared/lib": "v2", "README.md": "v2"})
+	names, err = Affected(config, first.String())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"web", "e2e"}, names)
+
+	// Uncommitted changes are taken into account
+	writeFile(t, filepath.Join(dir, "backend/Dockerfile"), "FROM alpine")
+	names, err = Affected(config, first.String())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"web", "backend", "e2e"}, names)
+
+	_, err = Affected(config, "nonexistent")
+	assert.Error(t, err)
+}
@@ -0,0 +1,242 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// defaultRegistry is the registry of the images without a registry host
+	defaultRegistry = "docker.io"
+
+	// defaultRegistryAddress is the key of the default registry in the
+	// docker configuration and credential helpers
+	defaultRegistryAddress = "https://index.docker.io/v1/"
+)
+
+// dockerConfig holds the registry settings of ~/.docker/config.json
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// registryHost returns the registry host of the image reference.
+func registryHost(image string) string {
+	i := strings.IndexRune(image, '/')
+	if i < 0 {
+		return defaultRegistry
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return defaultRegistry
+	}
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return defaultRegistry
+	}
+	return host
+}
+
+// registryAddress returns the key identifying the registry host in the docker
+// configuration.
+func registryAddress(host string) string {
+	if host == defaultRegistry {
+		return defaultRegistryAddress
+	}
+	return host
+}
+
+// normalizeRegistry strips the scheme and path of a registry address of the
+// docker configuration, returning its host.
+func normalizeRegistry(address string) string {
+	address = strings.TrimPrefix(address, "https://")
+	address = strings.TrimPrefix(address, "http://")
+	if i := strings.IndexRune(address, '/'); i >= 0 {
+		address = address[:i]
+	}
+	if address == "index.docker.io" || address == "registry-1.docker.io" {
+		return defaultRegistry
+	}
+	return address
+}
+
+// dockerConfigFile returns the path of the docker configuration file.
+func dockerConfigFile() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// readDockerConfig reads the docker configuration, returning an empty
+// configuration when it does not exist.
+func readDockerConfig() (dockerConfig, error) {
+	var conf dockerConfig
+	data, err := ioutil.ReadFile(dockerConfigFile())
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return conf, err
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return conf, fmt.Errorf("invalid docker configuration %s: %s", dockerConfigFile(), err)
+	}
+	return conf, nil
+}
+
+// resolveAuth returns the credentials to use for the registry host of the
+// image reference. They are looked up, in order, in the CAPTAIN_REGISTRY_USER
+// and CAPTAIN_REGISTRY_PASSWORD environment variables when the host is
+// CAPTAIN_REGISTRY, the credential helpers and the auths of the docker
+// configuration.
+func resolveAuth(image string) (docker.AuthConfiguration, error) {
+	conf, err := readDockerConfig()
+	if err != nil {
+		return docker.AuthConfiguration{}, err
+	}
+	return conf.resolve(registryHost(image))
+}
+
+// resolveAuthConfigs returns the credentials of every registry known by the
+// environment and the docker configuration, as used by builds. A registry
+// whose credential helper fails is reported on out and left out, so that the
+// build goes on without its credentials.
+func resolveAuthConfigs(out io.Writer) (docker.AuthConfigurations, error) {
+	configs := docker.AuthConfigurations{Configs: make(map[string]docker.AuthConfiguration)}
+
+	conf, err := readDockerConfig()
+	if err != nil {
+		return configs, err
+	}
+
+	hosts := make(map[string]bool)
+	for address := range conf.Auths {
+		hosts[normalizeRegistry(address)] = true
+	}
+	for address := range conf.CredHelpers {
+		hosts[normalizeRegistry(address)] = true
+	}
+	if host, ok := envRegistry(); ok {
+		hosts[host] = true
+	}
+
+	for host := range hosts {
+		auth, err := conf.resolve(host)
+		if err != nil {
+			fInfo(out, "Skipping the credentials of %s - %s", host, err)
+			continue
+		}
+		if auth.Username != "" {
+			configs.Configs[registryAddress(host)] = auth
+		}
+	}
+	return configs, nil
+}
+
+// envRegistry returns the registry host the environment credentials apply to.
+// They are only used when both CAPTAIN_REGISTRY and CAPTAIN_REGISTRY_USER are
+// set.
+func envRegistry() (string, bool) {
+	host := os.Getenv("CAPTAIN_REGISTRY")
+	if host == "" || os.Getenv("CAPTAIN_REGISTRY_USER") == "" {
+		return "", false
+	}
+	return normalizeRegistry(host), true
+}
+
+func (conf dockerConfig) resolve(host string) (docker.AuthConfiguration, error) {
+	address := registryAddress(host)
+	auth := docker.AuthConfiguration{ServerAddress: address}
+
+	// Environment variables
+	if envHost, ok := envRegistry(); ok && envHost == host {
+		auth.Username = os.Getenv("CAPTAIN_REGISTRY_USER")
+		auth.Password = os.Getenv("CAPTAIN_REGISTRY_PASSWORD")
+		return auth, nil
+	}
+
+	// Credential helpers
+	helper := conf.CredsStore
+	for key, h := range conf.CredHelpers {
+		if normalizeRegistry(key) == host {
+			helper = h
+		}
+	}
+	if helper != "" {
+		username, secret, err := credentialHelperGet(helper, address)
+		if err != nil {
+			return auth, err
+		}
+		if username != "" {
+			auth.Username = username
+			auth.Password = secret
+			return auth, nil
+		}
+	}
+
+	// Static credentials
+	for key, entry := range conf.Auths {
+		if normalizeRegistry(key) != host {
+			continue
+		}
+		auth.Username, auth.Password = entry.Username, entry.Password
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return auth, fmt.Errorf("invalid auth of %s in docker configuration: %s", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return auth, fmt.Errorf("invalid auth of %s in docker configuration", key)
+			}
+			auth.Username, auth.Password = parts[0], parts[1]
+		}
+		return auth, nil
+	}
+
+	return auth, nil
+}
+
+// credentialHelperGet runs `docker-credential-<helper> get` for the registry
+// address. Missing credentials are not an error.
+func credentialHelperGet(helper string, address string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(address)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("credential helper %s failed for %s: %s %s", helper, address, err, output)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("invalid output of credential helper %s: %s", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
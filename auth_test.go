@@ -0,0 +1,156 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// withDockerConfig points DOCKER_CONFIG to a temporary directory holding the
+// given config.json, and clears the captain registry environment variables.
+func withDockerConfig(t *testing.T, config string) func() {
+	dir, err := ioutil.TempDir("", "captain-auth")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+
+	env := map[string]string{}
+	for _, key := range []string{"DOCKER_CONFIG", "CAPTAIN_REGISTRY", "CAPTAIN_REGISTRY_USER", "CAPTAIN_REGISTRY_PASSWORD", "PATH"} {
+		env[key] = os.Getenv(key)
+	}
+	os.Setenv("DOCKER_CONFIG", dir)
+	os.Unsetenv("CAPTAIN_REGISTRY")
+	os.Unsetenv("CAPTAIN_REGISTRY_USER")
+	os.Unsetenv("CAPTAIN_REGISTRY_PASSWORD")
+
+	return func() {
+		for key, value := range env {
+			os.Setenv(key, value)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// installCredentialHelper installs a docker-credential-<name> script on PATH
+// answering the given JSON.
+func installCredentialHelper(t *testing.T, name string, output string) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	script := "#!/bin/sh\ncat > /dev/null\necho '" + output + "'\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte(script), 0755))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, "docker.io", registryHost("alpine"))
+	assert.Equal(t, "docker.io", registryHost("harbur/captain"))
+	assert.Equal(t, "docker.io", registryHost("index.docker.io/harbur/captain"))
+	assert.Equal(t, "quay.io", registryHost("quay.io/harbur/captain"))
+	assert.Equal(t, "localhost:5000", registryHost("localhost:5000/captain"))
+	assert.Equal(t, "localhost", registryHost("localhost/captain"))
+}
+
+func TestNormalizeRegistry(t *testing.T) {
+	assert.Equal(t, "docker.io", normalizeRegistry("https://index.docker.io/v1/"))
+	assert.Equal(t, "quay.io", normalizeRegistry("quay.io"))
+	assert.Equal(t, "localhost:5000", normalizeRegistry("http://localhost:5000/v2/"))
+}
+
+func TestResolveAuthStatic(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	defer withDockerConfig(t, `{"auths": {"https://index.docker.io/v1/": {"auth": "`+encoded+`"}}}`)()
+
+	auth, err := resolveAuth("harbur/captain")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", auth.Username)
+	assert.Equal(t, "secret", auth.Password)
+	assert.Equal(t, "https://index.docker.io/v1/", auth.ServerAddress)
+
+	auth, err = resolveAuth("quay.io/harbur/captain")
+	assert.NoError(t, err)
+	assert.Empty(t, auth.Username, "Other registries should not get the credentials")
+}
+
+func TestResolveAuthCredentialHelper(t *testing.T) {
+	defer withDockerConfig(t, `{"credsStore": "captainstore", "credHelpers": {"quay.io": "captainquay"}}`)()
+	installCredentialHelper(t, "captainstore", `{"Username": "store", "Secret": "s1"}`)
+	installCredentialHelper(t, "captainquay", `{"Username": "quay", "Secret": "s2"}`)
+
+	auth, err := resolveAuth("harbur/captain")
+	assert.NoError(t, err)
+	assert.Equal(t, "store", auth.Username)
+	assert.Equal(t, "s1", auth.Password)
+
+	auth, err = resolveAuth("quay.io/harbur/captain")
+	assert.NoError(t, err)
+	assert.Equal(t, "quay", auth.Username)
+	assert.Equal(t, "s2", auth.Password)
+}
+
+func TestResolveAuthEnvironment(t *testing.T) {
+	defer withDockerConfig(t, `{"credsStore": "captainstore"}`)()
+	installCredentialHelper(t, "captainstore", `{"Username": "store", "Secret": "s1"}`)
+	os.Setenv("CAPTAIN_REGISTRY_USER", "env")
+	os.Setenv("CAPTAIN_REGISTRY_PASSWORD", "s3")
+	os.Setenv("CAPTAIN_REGISTRY", "quay.io")
+
+	auth, err := resolveAuth("quay.io/harbur/captain")
+	assert.NoError(t, err)
+	assert.Equal(t, "env", auth.Username)
+	assert.Equal(t, "s3", auth.Password)
+
+	auth, err = resolveAuth("harbur/captain")
+	assert.NoError(t, err)
+	assert.Equal(t, "store", auth.Username, "Environment should only apply to CAPTAIN_REGISTRY")
+}
+
+func TestResolveAuthConfigs(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	defer withDockerConfig(t, `{"auths": {"quay.io": {"auth": "`+encoded+`"}}}`)()
+	os.Setenv("CAPTAIN_REGISTRY_USER", "env")
+	os.Setenv("CAPTAIN_REGISTRY_PASSWORD", "s3")
+	os.Setenv("CAPTAIN_REGISTRY", "localhost:5000")
+
+	configs, err := resolveAuthConfigs(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", configs.Configs["quay.io"].Username)
+	assert.Equal(t, "env", configs.Configs["localhost:5000"].Username)
+}
+
+func TestResolveAuthEnvironmentWithoutRegistry(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	defer withDockerConfig(t, `{"auths": {"quay.io": {"auth": "`+encoded+`"}}}`)()
+	os.Setenv("CAPTAIN_REGISTRY_USER", "env")
+	os.Setenv("CAPTAIN_REGISTRY_PASSWORD", "s3")
+
+	// Without CAPTAIN_REGISTRY, the environment credentials are ignored
+	auth, err := resolveAuth("quay.io/harbur/captain")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", auth.Username)
+
+	auth, err = resolveAuth("harbur/captain")
+	assert.NoError(t, err)
+	assert.Empty(t, auth.Username)
+
+	configs, err := resolveAuthConfigs(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", configs.Configs["quay.io"].Username)
+	assert.NotContains(t, configs.Configs, "")
+	assert.Len(t, configs.Configs, 1)
+}
+
+func TestResolveAuthConfigsFailingHelper(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	defer withDockerConfig(t, `{"auths": {"quay.io": {"auth": "`+encoded+`"}}, "credHelpers": {"gcr.io": "captainmissing"}}`)()
+
+	// The registry of the failing helper is left out, the others are kept
+	var out bytes.Buffer
+	configs, err := resolveAuthConfigs(&out)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", configs.Configs["quay.io"].Username)
+	assert.NotContains(t, configs.Configs, "gcr.io")
+	assert.Contains(t, out.String(), "Skipping the credentials of")
+}
@@ -0,0 +1,231 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// BackendDocker builds images with the legacy builder of the Docker daemon
+	BackendDocker = "docker"
+
+	// BackendBuildkit builds images with BuildKit through docker buildx
+	BackendBuildkit = "buildkit"
+
+	// BackendBuildx is an alias of BackendBuildkit
+	BackendBuildx = "buildx"
+)
+
+// PlatformPusher publishes the multi-platform image of an app as a manifest
+// list for every given tag.
+type PlatformPusher interface {
+	PushPlatforms(app App, pathConfig string, tags []string) error
+}
+
+// BuildxBuilder builds images with `docker buildx build` and loads them into
+// the Docker daemon, so that the other operations are left to the embedded
+// Builder.
+type BuildxBuilder struct {
+	Builder
+}
+
+func (b *BuildxBuilder) BuildImage(app App, tag string, pathConfig string, force bool) error {
+	out := app.stdout()
+
+	// Images for several platforms cannot be loaded into the daemon: build
+	// them all once into the platform cache, then load the native one and
+	// later push them all from that cache.
+	if len(app.Platforms) > 0 {
+		if err := checkBuildxDriver(); err != nil {
+			fError(out, err.Error())
+			return err
+		}
+		// The build args of the git metadata are not part of the hash the
+		// image is labeled with, which PushPlatforms looks the cache up by
+		hash, ok := app.labels[contextHashLabel]
+		if !ok {
+			var err error
+			if hash, err = contextHash(app, pathConfig); err != nil {
+				return err
+			}
+		}
+
+		fInfo(out, "Building image %s:%s for %s with BuildKit", app.Image, tag, strings.Join(app.Platforms, ","))
+		cache := platformCache(app, hash)
+		// Only the cache of the last build of the app is kept
+		if err := os.RemoveAll(filepath.Dir(cache)); err != nil {
+			return err
+		}
+		args := buildxArgs(app, pathConfig, force, "--platform", strings.Join(app.Platforms, ","), "--cache-to", "type=local,dest="+cache+",mode=max")
+		if err := executeWithOutput(out, "docker", args...); err != nil {
+			os.RemoveAll(cache)
+			return err
+		}
+
+		fInfo(out, "Loading image %s:%s", app.Image, tag)
+		args = buildxArgs(app, pathConfig, false, "--load", "--tag", app.Image+":"+tag, "--cache-from", "type=local,src="+cache)
+		return executeWithOutput(out, "docker", args...)
+	}
+
+	fInfo(out, "Building image %s:%s with BuildKit", app.Image, tag)
+	args := buildxArgs(app, pathConfig, force, "--load", "--tag", app.Image+":"+tag)
+	return executeWithOutput(out, "docker", args...)
+}
+
+// PushPlatforms pushes the image of every platform of the app as a manifest
+// list under each tag. The image is exported from the platform cache filled
+// by BuildImage, so that it is not built again.
+func (b *BuildxBuilder) PushPlatforms(app App, pathConfig string, tags []string) error {
+	out := app.stdout()
+	hash, err := contextHash(app, pathConfig)
+	if err != nil {
+		fError(out, "Could not hash the build context of %s: %s", app.Image, err)
+		return err
+	}
+	cache := platformCache(app, hash)
+	if _, err := os.Stat(cache); err != nil {
+		err := fmt.Errorf("no build of %s for %s found, build it first", app.Image, strings.Join(app.Platforms, ","))
+		fError(out, err.Error())
+		return err
+	}
+	fInfo(out, "Pushing image %s:%s for %s", app.Image, strings.Join(tags, ","), strings.Join(app.Platforms, ","))
+
+	flags := append(platformPushFlags(app, tags), "--cache-from", "type=local,src="+cache)
+	args := buildxArgs(app, pathConfig, false, flags...)
+	return executeWithOutput(out, "docker", args...)
+}
+
+// platformsBuilt reports whether the images of every platform of the app
+// are in the platform cache, built from its current context. Apps without
+// platforms have none to build.
+func platformsBuilt(app App, pathConfig string) bool {
+	if len(app.Platforms) == 0 {
+		return true
+	}
+	hash, err := contextHash(app, pathConfig)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(platformCache(app, hash))
+	return err == nil
+}
+
+// platformCache returns the local cache directory the images of every
+// platform of the app are built into from the context with the given hash.
+func platformCache(app App, hash string) string {
+	return filepath.Join(os.TempDir(), "captain-buildx", sanitizeTag(app.Image), strings.TrimPrefix(hash, "sha256:"))
+}
+
+// buildxDriver returns the driver of the current buildx builder.
+var buildxDriver = func() (string, error) {
+	inspect, err := oneliner("docker", "buildx", "inspect")
+	if err != nil {
+		return "", fmt.Errorf("could not inspect the buildx builder: %s", err)
+	}
+	for _, line := range strings.Split(inspect, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "Driver:" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("could not find the driver of the buildx builder")
+}
+
+// checkBuildxDriver returns an error unless the current buildx builder can
+// build for several platforms into a local cache, which the default docker
+// driver cannot.
+func checkBuildxDriver() error {
+	driver, err := buildxDriver()
+	if err != nil {
+		return err
+	}
+	if driver == "docker" {
+		return fmt.Errorf("platforms require a buildx builder with the docker-container driver, create one with `docker buildx create --use`")
+	}
+	return nil
+}
+
+func platformPushFlags(app App, tags []string) []string {
+	flags := []string{"--push", "--platform", strings.Join(app.Platforms, ",")}
+	for _, tag := range tags {
+		flags = append(flags, "--tag", app.Image+":"+tag)
+	}
+	return flags
+}
+
+// buildxArgs returns the docker CLI arguments building the image of the app,
+// with flags defining the output of the build.
+func buildxArgs(app App, pathConfig string, force bool, flags ...string) []string {
+	contextDir := path.Join(pathConfig, app.Context)
+
+	args := append([]string{"buildx", "build"}, flags...)
+	args = append(args, "--file", path.Join(contextDir, app.Build))
+	if app.Target != "" {
+		args = append(args, "--target", app.Target)
+	}
+	if force {
+		args = append(args, "--no-cache")
+	} else {
+		for _, ref := range app.Cache_from {
+			args = append(args, "--cache-from", buildxCacheFrom(ref, pathConfig))
+		}
+	}
+	for _, ref := range app.Cache_to {
+		args = append(args, "--cache-to", buildxCacheTo(ref, pathConfig))
+	}
+	if len(app.Cache_to) == 0 && len(app.Platforms) == 0 {
+		// Embed the cache metadata so that pushed images can be reused as cache
+		args = append(args, "--cache-to", "type=inline")
+	}
+
+	// Sort build args to keep the command line reproducible
+	var keys []string
+	for k := range app.Build_arg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--build-arg", k+"="+app.Build_arg[k])
+	}
+	args = append(args, labelFlags(app.labels)...)
+
+	var names []string
+	for k := range app.Annotations {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		args = append(args, "--annotation", k+"="+app.Annotations[k])
+	}
+
+	return append(args, contextDir)
+}
+
+// builderFor returns the Builder to use for the app. The backend of the
+// options takes precedence over the one of the app.
+func (opts BuildOptions) builderFor(app App) (Builder, error) {
+	backend := opts.Backend
+	if backend == "" {
+		backend = app.Backend
+	}
+
+	switch backend {
+	case "":
+		// Only BuildKit supports building for several platforms
+		if len(app.Platforms) > 0 {
+			return &BuildxBuilder{opts.Builder}, nil
+		}
+		return opts.Builder, nil
+	case BackendDocker:
+		if len(app.Platforms) > 0 {
+			return nil, fmt.Errorf("platforms of %s require the %s backend", app.Name, BackendBuildkit)
+		}
+		return opts.Builder, nil
+	case BackendBuildkit, BackendBuildx:
+		return &BuildxBuilder{opts.Builder}, nil
+	}
+	return nil, fmt.Errorf("unknown build backend %q for %s", backend, app.Name)
+}
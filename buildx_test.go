@@ -0,0 +1,155 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildxArgs(t *testing.T) {
+	app := App{
+		Build:     "Dockerfile.backend",
+		Image:     "harbur/test_backend",
+		Context:   "src",
+		Build_arg: map[string]string{"B": "2", "A": "1"},
+	}
+	args := buildxArgs(app, "/project", true, "--load", "--tag", "harbur/test_backend:latest")
+	assert.Equal(t, []string{
+		"buildx", "build", "--load",
+		"--tag", "harbur/test_backend:latest",
+		"--file", "/project/src/Dockerfile.backend",
+		"--no-cache",
+		"--cache-to", "type=inline",
+		"--build-arg", "A=1",
+		"--build-arg", "B=2",
+		"/project/src",
+	}, args)
+}
+
+func TestBuildxArgsLabels(t *testing.T) {
+	app := App{
+		Build:       "Dockerfile",
+		Image:       "harbur/test_web",
+		Context:     ".",
+		Annotations: map[string]string{"org.opencontainers.image.vendor": "harbur"},
+	}
+	app = app.withLabel("team", "platform")
+	args := buildxArgs(app, "/project", false, "--load")
+	assert.Equal(t, []string{
+		"buildx", "build", "--load",
+		"--file", "/project/Dockerfile",
+		"--cache-to", "type=inline",
+		"--label", "team=platform",
+		"--annotation", "org.opencontainers.image.vendor=harbur",
+		"/project",
+	}, args)
+}
+
+func TestBuildxArgsCache(t *testing.T) {
+	app := App{
+		Build:      "Dockerfile",
+		Image:      "harbur/test_web",
+		Context:    ".",
+		Cache_from: []string{"harbur/test_web:master", "./.cache"},
+		Cache_to:   []string{"harbur/test_web:cache"},
+	}
+	args := buildxArgs(app, "/project", false, "--load")
+	assert.Equal(t, []string{
+		"buildx", "build", "--load",
+		"--file", "/project/Dockerfile",
+		"--cache-from", "type=registry,ref=harbur/test_web:master",
+		"--cache-from", "type=local,src=/project/.cache",
+		"--cache-to", "type=registry,ref=harbur/test_web:cache,mode=max",
+		"/project",
+	}, args)
+}
+
+func TestBuilderFor(t *testing.T) {
+	fake := NewFakeDocker()
+	opts := BuildOptions{Builder: fake}
+
+	b, err := opts.builderFor(App{})
+	assert.NoError(t, err)
+	assert.Equal(t, fake, b, "Default backend should be the docker daemon")
+
+	b, err = opts.builderFor(App{Backend: BackendBuildkit})
+	assert.NoError(t, err)
+	assert.IsType(t, &BuildxBuilder{}, b)
+
+	b, err = opts.builderFor(App{Platforms: []string{"linux/amd64", "linux/arm64"}})
+	assert.NoError(t, err)
+	assert.IsType(t, &BuildxBuilder{}, b, "Platforms should use BuildKit")
+
+	opts.Backend = BackendDocker
+	b, err = opts.builderFor(App{Backend: BackendBuildkit})
+	assert.NoError(t, err)
+	assert.Equal(t, fake, b, "Options backend should take precedence")
+
+	_, err = opts.builderFor(App{Platforms: []string{"linux/arm64"}})
+	assert.Error(t, err, "Docker backend cannot build platforms")
+
+	opts.Backend = "kaniko"
+	_, err = opts.builderFor(App{})
+	assert.Error(t, err)
+}
+
+func TestPlatformPushFlags(t *testing.T) {
+	app := App{Image: "harbur/test_web", Platforms: []string{"linux/amd64", "linux/arm64"}}
+	flags := platformPushFlags(app, []string{"latest", "abcdef0"})
+	assert.Equal(t, []string{
+		"--push", "--platform", "linux/amd64,linux/arm64",
+		"--tag", "harbur/test_web:latest",
+		"--tag", "harbur/test_web:abcdef0",
+	}, flags)
+}
+
+func TestPlatformsBuilt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "captain")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+	pathConfig := basedir + "/test/Simple"
+
+	assert.True(t, platformsBuilt(App{Image: "harbur/test_web"}, pathConfig), "Apps without platforms have nothing to build")
+
+	app := App{Build: "Dockerfile", Image: "localhost:5000/harbur/test_web", Platforms: []string{"linux/amd64", "linux/arm64"}}
+	hash, err := contextHash(app, pathConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "captain-buildx", "localhost-5000-harbur-test_web", strings.TrimPrefix(hash, "sha256:")), platformCache(app, hash))
+	assert.False(t, platformsBuilt(app, pathConfig))
+	err = (&BuildxBuilder{NewFakeDocker()}).PushPlatforms(app, pathConfig, []string{"latest"})
+	assert.EqualError(t, err, "no build of localhost:5000/harbur/test_web for linux/amd64,linux/arm64 found, build it first")
+
+	assert.NoError(t, os.MkdirAll(platformCache(app, hash), 0755))
+	assert.True(t, platformsBuilt(app, pathConfig))
+
+	// The cache of another context does not count as built
+	app.Build_arg = map[string]string{"VERSION": "2"}
+	assert.False(t, platformsBuilt(app, pathConfig))
+}
+
+func TestBuildxArgsPlatforms(t *testing.T) {
+	app := App{Build: "Dockerfile", Image: "harbur/test_web", Context: ".", Platforms: []string{"linux/amd64", "linux/arm64"}}
+	args := buildxArgs(app, "/project", false, "--push")
+	assert.NotContains(t, args, "type=inline", "Platform builds should not export an inline cache")
+}
+
+func TestCheckBuildxDriver(t *testing.T) {
+	defer func(f func() (string, error)) { buildxDriver = f }(buildxDriver)
+
+	buildxDriver = func() (string, error) { return "docker", nil }
+	assert.EqualError(t, checkBuildxDriver(), "platforms require a buildx builder with the docker-container driver, create one with `docker buildx create --use`")
+
+	buildxDriver = func() (string, error) { return "docker-container", nil }
+	assert.NoError(t, checkBuildxDriver())
+
+	// The build fails before running buildx
+	buildxDriver = func() (string, error) { return "docker", nil }
+	app := App{Build: "Dockerfile", Image: "harbur/test_web", Platforms: []string{"linux/amd64", "linux/arm64"}, out: ioutil.Discard}
+	assert.Error(t, (&BuildxBuilder{NewFakeDocker()}).BuildImage(app, "latest", basedir+"/test/Simple", false))
+}
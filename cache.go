@@ -0,0 +1,59 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isLocalCache reports whether the cache reference is a local directory
+// instead of an image of a registry.
+func isLocalCache(ref string) bool {
+	return strings.HasPrefix(ref, ".") || filepath.IsAbs(ref)
+}
+
+// isRawCache reports whether the cache reference is a buildx cache
+// specification such as type=gha.
+func isRawCache(ref string) bool {
+	return strings.HasPrefix(ref, "type=")
+}
+
+// localCacheDir returns the local cache directory relative to the configuration.
+func localCacheDir(ref string, pathConfig string) string {
+	if filepath.IsAbs(ref) {
+		return ref
+	}
+	return path.Join(pathConfig, ref)
+}
+
+// buildxCacheFrom returns the buildx --cache-from value for the cache reference.
+func buildxCacheFrom(ref string, pathConfig string) string {
+	switch {
+	case isRawCache(ref):
+		return ref
+	case isLocalCache(ref):
+		return "type=local,src=" + localCacheDir(ref, pathConfig)
+	}
+	return "type=registry,ref=" + ref
+}
+
+// buildxCacheTo returns the buildx --cache-to value for the cache reference.
+func buildxCacheTo(ref string, pathConfig string) string {
+	switch {
+	case isRawCache(ref):
+		return ref
+	case isLocalCache(ref):
+		return "type=local,dest=" + localCacheDir(ref, pathConfig) + ",mode=max"
+	}
+	return "type=registry,ref=" + ref + ",mode=max"
+}
+
+// withDefaultCache returns the app reusing the branch image previously pushed
+// by captain as cache when it has no cache_from setting.
+func withDefaultCache(app App, branches []string) App {
+	if len(app.Cache_from) > 0 || len(branches) == 0 {
+		return app
+	}
+	app.Cache_from = []string{app.Image + ":" + branches[0]}
+	return app
+}
@@ -0,0 +1,31 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildxCacheFrom(t *testing.T) {
+	assert.Equal(t, "type=registry,ref=harbur/web:master", buildxCacheFrom("harbur/web:master", "/project"))
+	assert.Equal(t, "type=local,src=/project/.cache", buildxCacheFrom("./.cache", "/project"))
+	assert.Equal(t, "type=local,src=/tmp/cache", buildxCacheFrom("/tmp/cache", "/project"))
+	assert.Equal(t, "type=gha", buildxCacheFrom("type=gha", "/project"))
+}
+
+func TestBuildxCacheTo(t *testing.T) {
+	assert.Equal(t, "type=registry,ref=harbur/web:cache,mode=max", buildxCacheTo("harbur/web:cache", "/project"))
+	assert.Equal(t, "type=local,dest=/project/.cache,mode=max", buildxCacheTo("./.cache", "/project"))
+	assert.Equal(t, "type=gha,mode=max", buildxCacheTo("type=gha,mode=max", "/project"))
+}
+
+func TestWithDefaultCache(t *testing.T) {
+	app := withDefaultCache(App{Image: "harbur/web"}, []string{"feature", "master"})
+	assert.Equal(t, []string{"harbur/web:feature"}, app.Cache_from)
+
+	app = withDefaultCache(App{Image: "harbur/web", Cache_from: []string{"./.cache"}}, []string{"master"})
+	assert.Equal(t, []string{"./.cache"}, app.Cache_from, "Configured cache should be kept")
+
+	app = withDefaultCache(App{Image: "harbur/web"}, nil)
+	assert.Empty(t, app.Cache_from)
+}
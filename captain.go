@@ -1,25 +1,41 @@
 package captain // import "github.com/harbur/captain"
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Debug can be turned on to enable debug mode.
 var Debug bool
 
-// StatusError provides error code and id
+// StatusError provides error code and id. The operations print the error
+// before returning it, so that callers only need its status.
 type StatusError struct {
 	err    error
 	status int
 }
 
+// Error returns the message of the underlying error
+func (e StatusError) Error() string {
+	return e.err.Error()
+}
+
+// Status returns the exit status code of the error, as defined in exitstatus.go
+func (e StatusError) Status() int {
+	return e.status
+}
+
 // Pre function executes commands on pre section before build
 func Pre(app App) error {
 	for _, value := range app.Pre {
-		pInfo("Running pre command: %s", value)
-		res := execute("bash", "-c", value)
+		fInfo(app.stdout(), "Running pre command: %s", value)
+		res := executeWithOutput(app.stdout(), "bash", "-c", value)
 		if res != nil {
 			return res
 		}
@@ -30,8 +46,8 @@ func Pre(app App) error {
 // Post function executes commands on pre section after build
 func Post(app App) error {
 	for _, value := range app.Post {
-		pInfo("Running post command: %s", value)
-		res := execute("bash", "-c", value)
+		fInfo(app.stdout(), "Running post command: %s", value)
+		res := executeWithOutput(app.stdout(), "bash", "-c", value)
 		if res != nil {
 			return res
 		}
@@ -47,347 +63,552 @@ type BuildOptions struct {
 	Long_sha     bool
 	Branch_tags  bool
 	Commit_tags  bool
+
+	// Parallel is the maximum number of apps of the same dependency layer
+	// that are processed concurrently. Values lower than 2 process the apps
+	// one at a time.
+	Parallel int
+
+	// Backend selects how images are built, see BackendDocker and
+	// BackendBuildkit. When empty, the backend of each app is used.
+	Backend string
+
+	// Tag_policy defines the tags of the images, DefaultTagPolicy when nil
+	Tag_policy *TagPolicy
+
+	// Git_metadata passes the commit, branch, tag and build date as build
+	// args and sets the matching OCI labels on the images.
+	Git_metadata bool
+
+	// Reports are the files the test results are written to, as
+	// format=path where format is junit or json.
+	Reports []string
+
+	// Keep_going runs the tests of every app even when some fail.
+	Keep_going bool
+
+	// Context stops the running tests and tears down their services once
+	// done, e.g. on interrupt. It defaults to context.Background().
+	Context context.Context
+
+	// Builder, Registry and Runner default to a DockerBackend when nil
+	Builder  Builder
+	Registry Registry
+	Runner   Runner
 }
 
-// Build function compiles the Containers of the project
-func Build(opts BuildOptions) {
-	config := opts.Config
+// withBackend returns the options with the nil backends replaced by a
+// DockerBackend.
+func (opts BuildOptions) withBackend() (BuildOptions, error) {
+	if opts.Builder != nil && opts.Registry != nil && opts.Runner != nil {
+		return opts, nil
+	}
 
-	rev, err := getRevision(opts.Long_sha)
+	backend, err := NewDockerBackend()
 	if err != nil {
-		fmt.Println(err)
-		return
+		pError("Cannot connect to Docker: %s", err)
+		return opts, StatusError{err, ExecuteFailed}
+	}
+	if opts.Builder == nil {
+		opts.Builder = backend
 	}
+	if opts.Registry == nil {
+		opts.Registry = &RemoteRegistry{backend}
+	}
+	if opts.Runner == nil {
+		opts.Runner = backend
+	}
+	return opts, nil
+}
 
-	// For each App
-	for _, app := range config.GetApps() {
-		// If no Git repo exist
-		if !isGit() {
-			// Perfoming [build latest]
-			pDebug("No local git repository found, just building latest")
-
-			// Execute Pre commands
-			if res := Pre(app); res != nil {
-				pError("Pre execution returned non-zero status")
-				return
-			}
+// configError reports an error of the configuration, such as unresolvable
+// wants, with the InvalidCaptainYML status.
+func configError(err error) error {
+	pError(err.Error())
+	return StatusError{err, InvalidCaptainYML}
+}
 
-			// Build latest image
-			res := buildImage(app, "latest", config.GetPath(), opts.Force)
-			if res != nil {
-				os.Exit(BuildFailed)
-			}
+// forEachApp calls fn for every app of the configuration, layer by layer.
+// The apps of a layer run concurrently up to opts.Parallel, with their output
+// prefixed by the app name. It stops at the first layer returning an error.
+func forEachApp(opts BuildOptions, fn func(app App) error) error {
+	layers, err := opts.Config.GetAppLayers()
+	if err != nil {
+		return configError(err)
+	}
 
-			// Add additional user-defined Tag
-			if opts.Tag != "" {
-				if err := tagImage(app, "latest", opts.Tag); err != nil {
-					pError(err.Error())
-					return
+	if opts.Parallel < 2 {
+		for _, layer := range layers {
+			for _, app := range layer {
+				if err := fn(app); err != nil {
+					return err
 				}
 			}
-		} else {
-			// Skip build if there are no local changes and the commit is already built
-			if !isDirty() && imageExist(app, rev) && !opts.Force {
-				// Performing [skip rev|tag rev@latest|tag rev@branch]
-				pInfo("Skipping build of %s:%s - image is already built", app.Image, rev)
-
-				// Tag commit image
-				if err := tagImage(app, rev, "latest"); err != nil {
-					pError(err.Error())
-					return
-				}
+		}
+		return nil
+	}
 
-				// Tag branch image
-				branches, err := getBranches(opts.All_branches)
-				if err != nil {
-					pError(err.Error())
-					return
-				}
-				for _, branch := range branches {
-					res := tagImage(app, rev, branch)
-					if res != nil {
-						os.Exit(TagFailed)
-					}
-					res = tagImage(app, rev, branch+"-"+rev)
-					if res != nil {
-						os.Exit(TagFailed)
-					}
-				}
+	var mu sync.Mutex
+	for _, layer := range layers {
+		var wg sync.WaitGroup
+		var firstErr error
+		var errMu sync.Mutex
+		sem := make(chan struct{}, opts.Parallel)
+
+		for _, app := range layer {
+			sem <- struct{}{}
+
+			// Stop launching apps once one has failed
+			errMu.Lock()
+			failed := firstErr != nil
+			errMu.Unlock()
+			if failed {
+				<-sem
+				break
+			}
 
-				// Add additional user-defined Tag
-				if opts.Tag != "" {
-					if err := tagImage(app, rev, opts.Tag); err != nil {
-						pError(err.Error())
-						return
+			wg.Add(1)
+			go func(app App) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				out := newPrefixWriter(&mu, os.Stdout, colorPrefix(app.Name)+" | ")
+				defer out.Flush()
+				app.out = out
+
+				if err := fn(app); err != nil {
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
 					}
+					errMu.Unlock()
 				}
-			} else {
-				// Performing [build latest|tag latest@rev|tag latest@branch]
+			}(app)
+		}
+		wg.Wait()
 
-				// Execute Pre commands
-				if res := Pre(app); res != nil {
-					pError("Pre execution returned non-zero status")
-				}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+	return nil
+}
 
-				// Build latest image
-				res := buildImage(app, "latest", config.GetPath(), opts.Force)
-				if res != nil {
-					os.Exit(BuildFailed)
-				}
-				if isDirty() {
-					pDebug("Skipping tag of %s:%s - local changes exist", app.Image, rev)
-				} else {
-					// Tag commit image
-					if err := tagImage(app, "latest", rev); err != nil {
-						pError(err.Error())
-						return
-					}
+// Build function compiles the Containers of the project
+func Build(opts BuildOptions) error {
+	opts, err := opts.withBackend()
+	if err != nil {
+		return err
+	}
 
-					// Tag branch image
-					branches, err := getBranches(opts.All_branches)
-					if err != nil {
-						pError(err.Error())
-						return
-					}
-					for _, branch := range branches {
-						res := tagImage(app, "latest", branch)
-						if res != nil {
-							os.Exit(TagFailed)
-						}
-						res = tagImage(app, rev, branch+"-"+rev)
-						if res != nil {
-							os.Exit(TagFailed)
-						}
-					}
+	state, err := readGitState(opts.All_branches, opts.Long_sha)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, NoGit}
+	}
 
-					// Add additional user-defined Tag
-					if opts.Tag != "" {
-						if err := tagImage(app, rev, opts.Tag); err != nil {
-							pError(err.Error())
-							return
-						}
-					}
-				}
+	return forEachApp(opts, func(app App) error {
+		return buildApp(opts, app, state)
+	})
+}
+
+// buildImage builds the image of the app as tag. The image is labeled with
+// the hash of its build context, so that when an image built from the same
+// context already exists it is tagged instead of being rebuilt.
+func buildImage(opts BuildOptions, builder Builder, app App, tag string) error {
+	out := app.stdout()
+
+	for k, v := range app.Labels {
+		app = app.withLabel(k, v)
+	}
+
+	hash, err := contextHash(app, opts.Config.GetPath())
+	if err != nil {
+		fError(out, "Could not hash the build context of %s: %s", app.Image, err)
+		return StatusError{err, BuildFailed}
+	}
+	app = app.withLabel(contextHashLabel, hash)
+
+	// The git metadata differs between commits while the context hash does
+	// not, so an image built from another commit cannot be reused
+	if !opts.Force && !opts.Git_metadata {
+		existing, err := opts.Builder.ImageWithLabel(app, contextHashLabel, hash)
+		if err != nil {
+			fDebug(out, "Could not look up images of %s: %s", app.Image, err)
+		} else if existing != "" && platformsBuilt(app, opts.Config.GetPath()) {
+			fInfo(out, "Skipping build of %s - context unchanged since %s:%s", app.Image, app.Image, existing)
+			if existing == tag {
+				return nil
 			}
+			if err := opts.Builder.TagImage(app, existing, tag); err != nil {
+				fError(out, err.Error())
+				return StatusError{err, TagFailed}
+			}
+			return nil
 		}
+	}
+
+	if opts.Git_metadata {
+		app = readGitMetadata(time.Now()).apply(app)
+	}
+
+	if err := checkContextSize(app, opts.Config.GetPath()); err != nil {
+		fError(out, err.Error())
+		return StatusError{err, BuildFailed}
+	}
 
-		// Execute Post commands
-		if res := Post(app); res != nil {
-			pError("Post execution returned non-zero status")
+	if err := builder.BuildImage(app, tag, opts.Config.GetPath(), opts.Force); err != nil {
+		fError(out, "Build returned non-zero status")
+		return StatusError{err, BuildFailed}
+	}
+	return nil
+}
+
+// tagImage adds the tags to the origin image of the app.
+func tagImage(opts BuildOptions, app App, origin string, tags []managedTag) error {
+	for _, tag := range tags {
+		if tag.name == origin {
+			continue
+		}
+		if err := opts.Builder.TagImage(app, origin, tag.name); err != nil {
+			fError(app.stdout(), err.Error())
+			return StatusError{err, TagFailed}
 		}
 	}
+	return nil
 }
 
-// Test function executes the tests of the project
-func Test(opts BuildOptions) {
+func buildApp(opts BuildOptions, app App, state gitState) error {
 	config := opts.Config
+	out := app.stdout()
+	policy := opts.policy()
 
-	for _, app := range config.GetApps() {
-		for _, value := range app.Test {
-			pInfo("Running test command: %s", value)
-			res := execute("bash", "-c", value)
-			if res != nil {
-				pError("Test execution returned non-zero status")
-				os.Exit(ExecuteFailed)
+	builder, err := opts.builderFor(app)
+	if err != nil {
+		fError(out, err.Error())
+		return StatusError{err, BuildFailed}
+	}
+
+	// Fail early when the target stage is missing from the Dockerfile
+	if app.Target != "" {
+		dockerfile := path.Join(config.GetPath(), app.Context, app.Build)
+		ok, err := hasStage(dockerfile, app.Target)
+		if err == nil && !ok {
+			err = fmt.Errorf("target stage %s not found in %s", app.Target, dockerfile)
+		}
+		if err != nil {
+			fError(out, err.Error())
+			return StatusError{err, BuildFailed}
+		}
+	}
+
+	tags, err := policy.tags(state, app, opts.Tag)
+	if err != nil {
+		fError(out, err.Error())
+		return StatusError{err, NoGit}
+	}
+
+	// Reuse the last pushed image of the branch as cache
+	if state.git && !opts.Force {
+		app = withDefaultCache(app, policy.branchTags(state))
+	}
+
+	if !state.git {
+		fDebug(out, "No local git repository found, just building latest")
+	}
+
+	// Skip build if there are no local changes and the commit is already built
+	if state.git && !state.dirty && !opts.Force && opts.Builder.ImageExist(app, state.rev) && platformsBuilt(app, config.GetPath()) {
+		// Performing [skip rev|tag rev@latest|tag rev@branch]
+		fInfo(out, "Skipping build of %s:%s - image is already built", app.Image, state.rev)
+		if err := tagImage(opts, app, state.rev, tags); err != nil {
+			return err
+		}
+	} else {
+		// Performing [build latest|tag latest@rev|tag latest@branch]
+
+		// Execute Pre commands
+		if res := Pre(app); res != nil {
+			fError(out, "Pre execution returned non-zero status")
+			return StatusError{res, ExecuteFailed}
+		}
+
+		buildTag, err := policy.buildTag(state, opts.Tag)
+		if err != nil {
+			fError(out, err.Error())
+			return StatusError{err, NoGit}
+		}
+		if err := buildImage(opts, builder, app, buildTag); err != nil {
+			return err
+		}
+
+		if state.dirty {
+			fDebug(out, "Skipping tag of %s:%s - local changes exist", app.Image, state.rev)
+		} else if err := tagImage(opts, app, buildTag, tags); err != nil {
+			return err
+		}
+	}
+
+	// Execute Post commands
+	if res := Post(app); res != nil {
+		fError(out, "Post execution returned non-zero status")
+		return StatusError{res, ExecuteFailed}
+	}
+	return nil
+}
+
+// Test function executes the tests of the project
+func Test(opts BuildOptions) error {
+	opts, err := opts.withBackend()
+	if err != nil {
+		return err
+	}
+
+	// Container tests run against the image built by Build
+	state, err := readGitState(opts.All_branches, opts.Long_sha)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, NoGit}
+	}
+	tag, err := opts.policy().buildTag(state, opts.Tag)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, NoGit}
+	}
+
+	reports, err := parseReports(opts.Reports)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, ExecuteFailed}
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var mu sync.Mutex
+	var results []TestResult
+	var failed []string
+	err = forEachApp(opts, func(app App) error {
+		appResults := testApp(ctx, opts, app, app.Image+":"+tag)
+
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, appResults...)
+		for _, result := range appResults {
+			if result.Failed() {
+				failed = append(failed, app.Name)
+				if !opts.Keep_going {
+					return StatusError{errors.New(result.Failure), ExecuteFailed}
+				}
+				// Record each app once
+				break
 			}
 		}
+		return nil
+	})
+
+	if rerr := writeReports(reports, results); rerr != nil {
+		pError("Could not write the test report: %s", rerr)
+		if err == nil {
+			err = StatusError{rerr, IOFailed}
+		}
 	}
+	if err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		err := errors.New("tests interrupted")
+		pError(err.Error())
+		return StatusError{err, ExecuteFailed}
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("tests failed for %s", strings.Join(failed, ", "))
+		pError(err.Error())
+		return StatusError{err, ExecuteFailed}
+	}
+	return nil
+}
+
+// remoteTags returns the tags of the app exchanged with the remote registry.
+func remoteTags(opts BuildOptions, app App) ([]string, error) {
+	state, err := readGitState(opts.All_branches, opts.Long_sha)
+	if err != nil {
+		return nil, err
+	}
+	if !state.git {
+		return nil, errors.New("no local git repository found")
+	}
+
+	tags, err := opts.policy().tags(state, app, opts.Tag)
+	if err != nil {
+		return nil, err
+	}
+	return remote(tags, opts.Branch_tags, opts.Commit_tags), nil
 }
 
 // Push function pushes the containers to the remote registry
-func Push(opts BuildOptions) {
-	config := opts.Config
+func Push(opts BuildOptions) error {
+	opts, err := opts.withBackend()
+	if err != nil {
+		return err
+	}
 
 	// If no Git repo exist
 	if !isGit() {
 		pError("No local git repository found, cannot push")
-		os.Exit(NoGit)
+		return StatusError{errors.New("no local git repository found"), NoGit}
 	}
 
 	if isDirty() {
 		pError("Git repository has local changes, cannot push")
-		os.Exit(GitDirty)
+		return StatusError{errors.New("git repository has local changes"), GitDirty}
 	}
 
-	for _, app := range config.GetApps() {
-		branches, err := getBranches(opts.All_branches)
+	return forEachApp(opts, func(app App) error {
+		out := app.stdout()
+		tags, err := remoteTags(opts, app)
 		if err != nil {
-			pError(err.Error())
-			return
+			fError(out, err.Error())
+			return StatusError{err, NoGit}
 		}
-		for _, branch := range branches {
-			pInfo("Pushing image %s:%s", app.Image, "latest")
-			if res := pushImage(app.Image, "latest"); res != nil {
-				pError("Push returned non-zero status")
-				os.Exit(ExecuteFailed)
+
+		// Multi-platform images are published as manifest lists
+		if len(app.Platforms) > 0 {
+			builder, err := opts.builderFor(app)
+			if err != nil {
+				fError(out, err.Error())
+				return StatusError{err, ExecuteFailed}
 			}
-			if opts.Branch_tags {
-				pInfo("Pushing image %s:%s", app.Image, branch)
-				if res := pushImage(app.Image, branch); res != nil {
-					pError("Push returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
+			pusher, ok := builder.(PlatformPusher)
+			if !ok {
+				err := fmt.Errorf("backend of %s cannot push multi-platform images", app.Name)
+				fError(out, err.Error())
+				return StatusError{err, ExecuteFailed}
 			}
-			if opts.Commit_tags {
-				rev, err := getRevision(opts.Long_sha)
-				if err != nil {
-					pError(err.Error())
-					return
-				}
-				pInfo("Pushing image %s:%s", app.Image, rev)
-				if res := pushImage(app.Image, rev); res != nil {
-					pError("Push returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
+			if res := pusher.PushPlatforms(app, opts.Config.GetPath(), tags); res != nil {
+				fError(out, "Push returned non-zero status")
+				return StatusError{res, ExecuteFailed}
 			}
-			if opts.Branch_tags && opts.Commit_tags {
-				rev, err := getRevision(opts.Long_sha)
-				if err != nil {
-					pError(err.Error())
-					return
-				}
+			return nil
+		}
 
-				branchRevTag := branch + "-" + rev
-				pInfo("Pushing image %s:%s", app.Image, branchRevTag)
-				if res := pushImage(app.Image, branchRevTag); res != nil {
-					pError("Push returned non-zero status")
-					os.Exit(ExecuteFailed)
+		// Upload the first tag, the other ones are copies of its manifest
+		tagger, remote := opts.Registry.(RemoteTagger)
+		for i, tag := range tags {
+			if i > 0 && remote {
+				err := tagger.TagRemote(app, tags[0], tag)
+				if err == nil {
+					continue
 				}
+				fDebug(out, "Remote tagging of %s:%s failed, pushing it instead: %s", app.Image, tag, err)
 			}
 
-			// Add additional user-defined Tag
-			if opts.Tag != "" {
-				pInfo("Pushing image %s:%s", app.Image, opts.Tag)
-				if res := pushImage(app.Image, opts.Tag); res != nil {
-					pError("Push returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
+			fInfo(out, "Pushing image %s:%s", app.Image, tag)
+			if res := opts.Registry.PushImage(app, tag); res != nil {
+				fError(out, "Push returned non-zero status")
+				return StatusError{res, ExecuteFailed}
 			}
 		}
-	}
+		return nil
+	})
 }
 
 // Pull function pulls the containers from the remote registry
-func Pull(opts BuildOptions) {
-	config := opts.Config
+func Pull(opts BuildOptions) error {
+	opts, err := opts.withBackend()
+	if err != nil {
+		return err
+	}
 
-	for _, app := range config.GetApps() {
-		branches, err := getBranches(opts.All_branches)
+	return forEachApp(opts, func(app App) error {
+		out := app.stdout()
+		tags, err := remoteTags(opts, app)
 		if err != nil {
-			pError(err.Error())
-			return
+			fError(out, err.Error())
+			return StatusError{err, NoGit}
 		}
-		for _, branch := range branches {
-			pInfo("Pulling image %s:%s", app.Image, "latest")
-			if res := pullImage(app.Image, "latest"); res != nil {
-				pError("Pull returned non-zero status")
-				os.Exit(ExecuteFailed)
-			}
-			if opts.Branch_tags {
-				pInfo("Pulling image %s:%s", app.Image, branch)
-				if res := pullImage(app.Image, branch); res != nil {
-					pError("Pull returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
-			}
-			if opts.Commit_tags {
-				rev, err := getRevision(opts.Long_sha)
-				if err != nil {
-					pError(err.Error())
-					return
-				}
-
-				pInfo("Pulling image %s:%s", app.Image, rev)
-				if res := pullImage(app.Image, rev); res != nil {
-					pError("Pull returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
-			}
-			if opts.Branch_tags && opts.Commit_tags {
-				rev, err := getRevision(opts.Long_sha)
-				if err != nil {
-					pError(err.Error())
-					return
-				}
-
-				branchRevTag := branch + "-" + rev
-				pInfo("Pulling image %s:%s", app.Image, branchRevTag)
-				if res := pullImage(app.Image, branchRevTag); res != nil {
-					pError("Pull returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
-			}
 
-			// Add additional user-defined Tag
-			if opts.Tag != "" {
-				pInfo("Pulling image %s:%s", app.Image, opts.Tag)
-				if res := pullImage(app.Image, opts.Tag); res != nil {
-					pError("Pull returned non-zero status")
-					os.Exit(ExecuteFailed)
-				}
+		for _, tag := range tags {
+			fInfo(out, "Pulling image %s:%s", app.Image, tag)
+			if res := opts.Registry.PullImage(app, tag); res != nil {
+				fError(out, "Pull returned non-zero status")
+				return StatusError{res, ExecuteFailed}
 			}
 		}
-	}
+		return nil
+	})
 }
 
 // Purge function purges the stale images
-func Purge(opts BuildOptions) {
-	config := opts.Config
+func Purge(opts BuildOptions) error {
+	opts, err := opts.withBackend()
+	if err != nil {
+		return err
+	}
+	apps, err := opts.Config.GetApps()
+	if err != nil {
+		return configError(err)
+	}
 
-	// For each App
-	for _, app := range config.GetApps() {
-		var tags = []string{}
+	state, err := readGitState(opts.All_branches, opts.Long_sha)
+	if err == nil && !state.git {
+		err = errors.New("no local git repository found")
+	}
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, NoGit}
+	}
 
+	// For each App
+	for _, app := range apps {
 		// Retrieve the list of the existing Image tags
-		for _, img := range getImages(app) {
-			tags = append(tags, img.RepoTags...)
-		}
-
-		// Remove from the list: The latest image
-		for key, tag := range tags {
-			if tag == app.Image+":latest" {
-				tags = append(tags[:key], tags[key+1:]...)
-			}
-		}
-
-		// Remove from the list: The current commit-id
-		for key, tag := range tags {
-			rev, err := getRevision(opts.Long_sha)
-			if err != nil {
-				pError(err.Error())
-				return
-			}
-			if tag == app.Image+":"+rev {
-				tags = append(tags[:key], tags[key+1:]...)
-			}
+		tags, err := opts.Builder.GetImages(app)
+		if err != nil {
+			pError(err.Error())
+			return StatusError{err, ExecuteFailed}
 		}
 
-		// Remove from the list: The working-dir git branches
-		branches, err := getBranches(opts.All_branches)
+		// Keep the tags of the policy, including latest when it manages
+		// it, and the branch-commit images of the working-dir git branches
+		managed, err := opts.policy().tags(state, app, opts.Tag)
 		if err != nil {
 			pError(err.Error())
-			return
+			return StatusError{err, NoGit}
+		}
+		keep := make(map[string]bool)
+		for _, tag := range managed {
+			keep[app.Image+":"+tag.name] = true
 		}
+		branches := opts.policy().branchTags(state)
 
-		for _, branch := range branches {
-			for key, tag := range tags {
-				if tag == app.Image+":"+branch {
-					tags = append(tags[:key], tags[key+1:]...)
-				}
-				if strings.Contains(tag, app.Image+":"+branch+"-") {
-					tags = append(tags[:key], tags[key+1:]...)
+		var stale []string
+		for _, tag := range tags {
+			if keep[tag] {
+				continue
+			}
+			current := false
+			for _, branch := range branches {
+				if strings.HasPrefix(tag, app.Image+":"+branch+"-") {
+					current = true
 				}
 			}
+			if !current {
+				stale = append(stale, tag)
+			}
 		}
 
 		// Proceed with deletion of Images
-		for _, tag := range tags {
+		for _, tag := range stale {
 			pInfo("Deleting image %s", tag)
-			res := removeImage(tag)
+			res := opts.Builder.RemoveImage(tag)
 			if res != nil {
 				pError("Deleting image failed: %s", res)
-				os.Exit(DeleteImageFailed)
+				return StatusError{res, DeleteImageFailed}
 			}
 		}
 	}
+	return nil
 }
@@ -1,9 +1,16 @@
 package captain // import "github.com/harbur/captain"
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	git "gopkg.in/src-d/go-git.v4"
 )
 
 // Test Fixtures
@@ -42,43 +49,276 @@ func TestPostFail(t *testing.T) {
 
 // Build Command
 func TestBuild(t *testing.T) {
-	var testConfig = readConfig(configFile(basedir + "/test/Simple/captain.yml"))
+	testConfig, err := readConfig(configFile(basedir+"/test/Simple/captain.yml"), false)
+	assert.NoError(t, err)
 
+	fake := NewFakeDocker()
 	var buildOpts = BuildOptions{
-		Config: testConfig,
+		Config:   testConfig,
+		Builder:  fake,
+		Registry: fake,
+	}
+
+	assert.NoError(t, Build(buildOpts))
+	assert.Contains(t, fake.Tags("harbur/test_web"), "latest")
+	assert.Contains(t, fake.Tags("harbur/test_backend"), "latest")
+}
+
+// oneImageRepo changes to a new git repository on master holding the
+// project of test/OneImage in a single commit. It returns the configuration
+// of the project, the short revision of the commit, the worktree and a
+// function restoring the working directory.
+func oneImageRepo(t *testing.T) (Config, string, *git.Worktree, func()) {
+	dir, err := ioutil.TempDir("", "captain")
+	assert.NoError(t, err)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	r, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	w, err := r.Worktree()
+	assert.NoError(t, err)
+
+	files := make(map[string]string)
+	for _, name := range []string{"captain.yml", "Dockerfile"} {
+		data, err := ioutil.ReadFile(filepath.Join(basedir, "test", "OneImage", name))
+		assert.NoError(t, err)
+		files[name] = string(data)
+	}
+	head := commitFiles(t, w, files)
+
+	wd, _ := os.Getwd()
+	assert.NoError(t, os.Chdir(dir))
+	config, err := readConfig(configFile(filepath.Join(dir, "captain.yml")), false)
+	assert.NoError(t, err)
+
+	return config, head.String()[:7], w, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	testConfig, rev, w, cleanup := oneImageRepo(t)
+	defer cleanup()
+
+	fake := NewFakeDocker()
+	var buildOpts = BuildOptions{
+		Config:   testConfig,
+		Tag:      "custom",
+		Builder:  fake,
+		Registry: fake,
+	}
+	assert.NoError(t, Build(buildOpts))
+	assert.Equal(t, []string{"harbur/test_web:latest"}, fake.Built)
+	assert.ElementsMatch(t, []string{"latest", rev, "custom", "master", "master-" + rev}, fake.Tags("harbur/test_web"))
+
+	// Local changes only tag latest
+	writeFile(t, filepath.Join(w.Filesystem.Root(), "Dockerfile"), "FROM alpine")
+	fake = NewFakeDocker()
+	buildOpts.Builder, buildOpts.Registry = fake, fake
+	assert.NoError(t, Build(buildOpts))
+	assert.Equal(t, []string{"latest"}, fake.Tags("harbur/test_web"), "Dirty repository should only tag latest")
+}
+
+func TestBuildSkipsBuiltCommit(t *testing.T) {
+	testConfig, rev, _, cleanup := oneImageRepo(t)
+	defer cleanup()
+
+	fake := NewFakeDocker("harbur/test_web:" + rev)
+	var buildOpts = BuildOptions{
+		Config:   testConfig,
+		Builder:  fake,
+		Registry: fake,
 	}
+	assert.NoError(t, Build(buildOpts))
+	assert.Empty(t, fake.Built, "Image should not be rebuilt")
+	assert.Contains(t, fake.Tags("harbur/test_web"), "latest")
+}
+
+func TestBuildReusesContextHash(t *testing.T) {
+	testConfig, err := readConfig(configFile(basedir+"/test/OneImage/captain.yml"), false)
+	assert.NoError(t, err)
 
-	Build(buildOpts)
+	fake := NewFakeDocker()
+	var buildOpts = BuildOptions{
+		Config:   testConfig,
+		Builder:  fake,
+		Registry: fake,
+	}
+	assert.NoError(t, Build(buildOpts))
+	assert.Equal(t, []string{"harbur/test_web:latest"}, fake.Built)
+
+	// An image of the same context is tagged instead of rebuilt
+	assert.NoError(t, fake.TagImage(testConfig.GetApp("web"), "latest", "previous"))
+	assert.NoError(t, fake.RemoveImage("harbur/test_web:latest"))
+	assert.NoError(t, Build(buildOpts))
+	assert.Equal(t, []string{"harbur/test_web:latest"}, fake.Built)
+	assert.Contains(t, fake.Tags("harbur/test_web"), "latest")
+
+	// Unless forced
+	buildOpts.Force = true
+	assert.NoError(t, Build(buildOpts))
+	assert.Equal(t, []string{"harbur/test_web:latest", "harbur/test_web:latest"}, fake.Built)
+}
+
+func TestBuildFailure(t *testing.T) {
+	testConfig, err := readConfig(configFile(basedir+"/test/OneImage/captain.yml"), false)
+	assert.NoError(t, err)
+
+	fake := NewFakeDocker()
+	fake.BuildErr = errors.New("build failed")
+	var buildOpts = BuildOptions{
+		Config:   testConfig,
+		Force:    true,
+		Builder:  fake,
+		Registry: fake,
+	}
+	err = Build(buildOpts)
+	assert.Error(t, err)
+	assert.Equal(t, BuildFailed, err.(StatusError).Status())
 }
 
 // Test Command
 func TestTest(t *testing.T) {
-	var testConfig = readConfig(configFile(basedir + "/test/Simple/captain.yml"))
+	testConfig, err := readConfig(configFile(basedir+"/test/Simple/captain.yml"), false)
+	assert.NoError(t, err)
 
 	var buildOpts = BuildOptions{
 		Config: testConfig,
 	}
 
-	Test(buildOpts)
+	assert.NoError(t, Test(buildOpts))
 }
 
 // Pull Command
 func TestPullNoBranchTags(t *testing.T) {
-	var testConfig = readConfig(configFile(basedir + "/test/alpine/captain.yml"))
+	testConfig, err := readConfig(configFile(basedir+"/test/alpine/captain.yml"), false)
+	assert.NoError(t, err)
 
+	fake := NewFakeDocker()
 	var buildOpts = BuildOptions{
 		Config:      testConfig,
 		Branch_tags: false,
+		Builder:     fake,
+		Registry:    fake,
 	}
-	Pull(buildOpts)
+	assert.NoError(t, Pull(buildOpts))
+	assert.Contains(t, fake.Pulled, "alpine:latest")
 }
 
 // Purge Command
 func TestPurge(t *testing.T) {
-	var testConfig = readConfig(configFile(basedir + "/test/alpine/captain.yml"))
+	testConfig, err := readConfig(configFile(basedir+"/test/alpine/captain.yml"), false)
+	assert.NoError(t, err)
 
+	fake := NewFakeDocker("alpine:latest", "alpine:stale")
 	var buildOpts = BuildOptions{
-		Config: testConfig,
+		Config:   testConfig,
+		Builder:  fake,
+		Registry: fake,
+	}
+	assert.NoError(t, Purge(buildOpts))
+	assert.Equal(t, []string{"alpine:stale"}, fake.Removed)
+
+	// latest is only kept when the policy manages it
+	fake = NewFakeDocker("alpine:latest", "alpine:stale")
+	buildOpts.Builder, buildOpts.Registry = fake, fake
+	buildOpts.Tag_policy = &TagPolicy{Sanitize: true}
+	assert.NoError(t, Purge(buildOpts))
+	assert.Equal(t, []string{"alpine:latest", "alpine:stale"}, fake.Removed)
+}
+
+func TestStatusError(t *testing.T) {
+	err := StatusError{errors.New("build failed"), BuildFailed}
+	assert.Equal(t, "build failed", err.Error())
+	assert.Equal(t, BuildFailed, err.Status())
+}
+
+// Push Command
+func TestPush(t *testing.T) {
+	testConfig, rev, _, cleanup := oneImageRepo(t)
+	defer cleanup()
+
+	fake := NewFakeDocker()
+	var buildOpts = BuildOptions{
+		Config:      testConfig,
+		Branch_tags: true,
+		Commit_tags: true,
+		Builder:     fake,
+		Registry:    fake,
 	}
-	Purge(buildOpts)
+	assert.NoError(t, Build(buildOpts))
+	assert.NoError(t, Push(buildOpts))
+	assert.Equal(t, []string{
+		"harbur/test_web:latest",
+		"harbur/test_web:master",
+		"harbur/test_web:" + rev,
+		"harbur/test_web:master-" + rev,
+	}, fake.Pushed)
+}
+
+func TestBuildTargets(t *testing.T) {
+	testConfig, err := readConfig(configFile(basedir+"/test/Stages/captain.yml"), false)
+	assert.NoError(t, err)
+
+	fake := NewFakeDocker()
+	var buildOpts = BuildOptions{
+		Config:   testConfig,
+		Force:    true,
+		Builder:  fake,
+		Registry: fake,
+	}
+	assert.NoError(t, Build(buildOpts))
+	assert.Contains(t, fake.Built, "harbur/test_stages:latest")
+	assert.Contains(t, fake.Built, "harbur/test_stages-test:latest")
+}
+
+func TestBuildMissingTarget(t *testing.T) {
+	testConfig, err := readConfig(configFile(basedir+"/test/Stages/captain.yml"), false)
+	assert.NoError(t, err)
+	app := testConfig.Apps["web"]
+	app.Target = "nonexistent"
+	testConfig.Apps["web"] = app
+
+	fake := NewFakeDocker()
+	var buildOpts = BuildOptions{
+		Config:   testConfig,
+		Force:    true,
+		Builder:  fake,
+		Registry: fake,
+	}
+	err = Build(buildOpts)
+	assert.Error(t, err)
+	assert.Equal(t, BuildFailed, err.(StatusError).Status())
+}
+
+func TestForEachAppParallelStopsOnError(t *testing.T) {
+	c, err := unmarshal("captain.yml", []byte(`
+web:
+  image: harbur/web
+backend:
+  image: harbur/backend
+worker:
+  image: harbur/worker
+cron:
+  image: harbur/cron
+`), false)
+	assert.NoError(t, err)
+
+	// The first app launched fails while the second one is still running
+	var mu sync.Mutex
+	launched := 0
+	err = forEachApp(BuildOptions{Config: c, Parallel: 2}, func(app App) error {
+		mu.Lock()
+		launched++
+		first := launched == 1
+		mu.Unlock()
+		if first {
+			return errors.New("build failed")
+		}
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	assert.EqualError(t, err, "build failed")
+	assert.Equal(t, 2, launched, "No app should be launched after a failure")
 }
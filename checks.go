@@ -0,0 +1,311 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Checks are properties of the image of an app which are asserted before
+// running its tests.
+type Checks struct {
+	// Files must exist in the image, with the given mode if any
+	Files []FileCheck `yaml:"files,omitempty"`
+
+	// Commands are run in containers of the image
+	Commands []CommandCheck `yaml:"commands,omitempty"`
+
+	// Non_root requires the image to run as a user other than root
+	Non_root bool `yaml:"non_root,omitempty"`
+
+	// Env, Labels and Ports must be set in the image
+	Env    map[string]string `yaml:"env,omitempty"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+	Ports  []string          `yaml:"ports,omitempty"`
+}
+
+// FileCheck asserts that a file exists in the image
+type FileCheck struct {
+	Path string `yaml:"path"`
+
+	// Mode is the octal permissions of the file, such as 0755
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// CommandCheck asserts the outcome of a command run in the image
+type CommandCheck struct {
+	Command []string `yaml:"command"`
+
+	// Output is a regular expression the output of the command must match
+	Output    string `yaml:"output,omitempty"`
+	Exit_code int    `yaml:"exit_code,omitempty"`
+}
+
+var (
+	checksKeys       = []string{"files", "commands", "non_root", "env", "labels", "ports"}
+	fileCheckKeys    = []string{"path", "mode"}
+	commandCheckKeys = []string{"command", "output", "exit_code"}
+)
+
+var portRegexp = regexp.MustCompile(`^[0-9]+(/(tcp|udp|sctp))?$`)
+
+func (c *Checks) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return &nodeError{value, "invalid checks, expected a mapping"}
+	}
+	if err := checkKeys(value, checksKeys, "checks"); err != nil {
+		return err
+	}
+
+	type rawChecks Checks
+	var raw rawChecks
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	*c = Checks(raw)
+
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if value.Content[i].Value != "ports" {
+			continue
+		}
+		for j, port := range c.Ports {
+			if !portRegexp.MatchString(port) {
+				return &nodeError{value.Content[i+1].Content[j], fmt.Sprintf("invalid port %q in checks, expected a port such as 8080/tcp", port)}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FileCheck) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return &nodeError{value, "invalid file check, expected a mapping"}
+	}
+	if err := checkKeys(value, fileCheckKeys, "file check"); err != nil {
+		return err
+	}
+
+	type rawFileCheck FileCheck
+	var raw rawFileCheck
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	*f = FileCheck(raw)
+
+	if f.Path == "" {
+		return &nodeError{value, "missing path in file check"}
+	}
+	if f.Mode != "" {
+		if _, err := strconv.ParseUint(f.Mode, 8, 32); err != nil {
+			return &nodeError{value, fmt.Sprintf("invalid mode %q in file check, expected octal permissions such as 0755", f.Mode)}
+		}
+	}
+	return nil
+}
+
+func (c *CommandCheck) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return &nodeError{value, "invalid command check, expected a mapping"}
+	}
+	if err := checkKeys(value, commandCheckKeys, "command check"); err != nil {
+		return err
+	}
+
+	var raw struct {
+		Command   yaml.Node `yaml:"command"`
+		Output    string    `yaml:"output"`
+		Exit_code int       `yaml:"exit_code"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	command, err := decodeCommand(&raw.Command)
+	if err != nil {
+		return err
+	}
+	*c = CommandCheck{Command: command, Output: raw.Output, Exit_code: raw.Exit_code}
+
+	if len(c.Command) == 0 {
+		return &nodeError{value, "missing command in command check"}
+	}
+	if _, err := regexp.Compile(c.Output); err != nil {
+		return &nodeError{value, fmt.Sprintf("invalid output %q in command check: %s", c.Output, err)}
+	}
+	return nil
+}
+
+// ImageConfig is the configuration of an image the checks are evaluated on
+type ImageConfig struct {
+	User   string
+	Env    []string
+	Labels map[string]string
+
+	// Ports are the exposed ports, such as 8080/tcp, sorted
+	Ports []string
+}
+
+// runChecks evaluates the checks of the app against the image, returning a
+// result per check.
+func runChecks(ctx context.Context, opts BuildOptions, app App, image string) []TestResult {
+	checks := app.Checks
+	out := app.stdout()
+	var results []TestResult
+	check := func(name string, fn func() string) {
+		start := time.Now()
+		result := TestResult{App: app.Name, Command: "check " + name, Attempts: 1}
+		if ctx.Err() != nil {
+			result.Status, result.Skipped, result.Failure = -1, true, "the tests were interrupted"
+		} else if result.Failure = fn(); result.Failure != "" {
+			result.Status = 1
+			fError(out, "Check of %s failed: %s: %s", app.Name, name, result.Failure)
+		} else {
+			fInfo(out, "Check of %s passed: %s", app.Name, name)
+		}
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+
+	if checks.Non_root || len(checks.Env) > 0 || len(checks.Labels) > 0 || len(checks.Ports) > 0 {
+		config, err := opts.Runner.InspectImage(image)
+		if err != nil {
+			check("image configuration", func() string { return err.Error() })
+		} else {
+			checkConfig(checks, config, check)
+		}
+	}
+
+	for _, file := range checks.Files {
+		name := "file " + file.Path
+		if file.Mode != "" {
+			name += " has mode " + file.Mode
+		}
+		check(name, func() string {
+			mode, err := opts.Runner.FileMode(image, file.Path)
+			if os.IsNotExist(err) {
+				return fmt.Sprintf("%s does not exist", file.Path)
+			}
+			if err != nil {
+				return err.Error()
+			}
+			if file.Mode != "" {
+				want, _ := strconv.ParseUint(file.Mode, 8, 32)
+				if got := permBits(mode); got != want {
+					return fmt.Sprintf("%s has mode %04o", file.Path, got)
+				}
+			}
+			return ""
+		})
+	}
+
+	for _, command := range checks.Commands {
+		test := TestCommand{Command: command.Command}
+		check("command "+test.String(), func() string {
+			var output bytes.Buffer
+			code, err := opts.Runner.RunContainer(ctx, ContainerOptions{Image: image, Command: command.Command}, &output, &output)
+			if err != nil {
+				return err.Error()
+			}
+			if code != command.Exit_code {
+				return fmt.Sprintf("exited with status %d instead of %d: %s", code, command.Exit_code, strings.TrimSpace(output.String()))
+			}
+			if command.Output != "" && !regexp.MustCompile(command.Output).Match(output.Bytes()) {
+				return fmt.Sprintf("output %q does not match %q", strings.TrimSpace(output.String()), command.Output)
+			}
+			return ""
+		})
+	}
+	return results
+}
+
+// checkConfig evaluates the checks of the configuration of the image.
+func checkConfig(checks Checks, config ImageConfig, check func(name string, fn func() string)) {
+	if checks.Non_root {
+		check("user is not root", func() string {
+			user := strings.Split(config.User, ":")[0]
+			if user == "" || user == "root" || user == "0" {
+				return "the image runs as root"
+			}
+			return ""
+		})
+	}
+
+	env := make(map[string]string)
+	for _, e := range config.Env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	for _, k := range sortedKeys(checks.Env) {
+		check(fmt.Sprintf("env %s=%s", k, checks.Env[k]), func() string {
+			return compareValue("env "+k, env, k, checks.Env[k])
+		})
+	}
+	for _, k := range sortedKeys(checks.Labels) {
+		check(fmt.Sprintf("label %s=%s", k, checks.Labels[k]), func() string {
+			return compareValue("label "+k, config.Labels, k, checks.Labels[k])
+		})
+	}
+
+	for _, port := range checks.Ports {
+		if !strings.Contains(port, "/") {
+			port += "/tcp"
+		}
+		check("port "+port+" is exposed", func() string {
+			if !contains(config.Ports, port) {
+				return fmt.Sprintf("port %s is not exposed", port)
+			}
+			return ""
+		})
+	}
+}
+
+// empty reports whether the checks assert nothing
+func (c Checks) empty() bool {
+	return len(c.Files) == 0 && len(c.Commands) == 0 && !c.Non_root &&
+		len(c.Env) == 0 && len(c.Labels) == 0 && len(c.Ports) == 0
+}
+
+func compareValue(name string, values map[string]string, key, want string) string {
+	got, ok := values[key]
+	if !ok {
+		return fmt.Sprintf("%s is not set", name)
+	}
+	if got != want {
+		return fmt.Sprintf("%s is %q", name, got)
+	}
+	return ""
+}
+
+// permBits returns the unix permission bits of the mode, including the
+// setuid, setgid and sticky bits.
+func permBits(mode os.FileMode) uint64 {
+	bits := uint64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
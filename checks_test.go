@@ -0,0 +1,170 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestUnmarshalChecks(t *testing.T) {
+	var c Checks
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+files:
+  - path: /app/server
+    mode: "0755"
+commands:
+  - command: /app/server --version
+    output: ^v\d+
+  - command: [/app/server, --fail]
+    exit_code: 2
+non_root: true
+env:
+  NODE_ENV: production
+labels:
+  team: platform
+ports:
+  - 8080
+  - 53/udp
+`), &c))
+
+	assert.Equal(t, Checks{
+		Files: []FileCheck{{Path: "/app/server", Mode: "0755"}},
+		Commands: []CommandCheck{
+			{Command: []string{"sh", "-c", "/app/server --version"}, Output: `^v\d+`},
+			{Command: []string{"/app/server", "--fail"}, Exit_code: 2},
+		},
+		Non_root: true,
+		Env:      map[string]string{"NODE_ENV": "production"},
+		Labels:   map[string]string{"team": "platform"},
+		Ports:    []string{"8080", "53/udp"},
+	}, c)
+	assert.False(t, c.empty())
+	assert.True(t, Checks{}.empty())
+}
+
+func TestValidateChecks(t *testing.T) {
+	for data, message := range map[string]string{
+		"non_root: true\n      user: app":                  `app web: unknown key "user" in checks`,
+		"files:\n        - mode: \"0755\"":                 "app web: missing path in file check",
+		"files:\n        - {path: /a, mode: rwx}":          `app web: invalid mode "rwx" in file check, expected octal permissions such as 0755`,
+		"commands:\n        - output: ok":                  "app web: missing command in command check",
+		"commands:\n        - {command: a, output: \"(\"}": "app web: invalid output \"(\" in command check: error parsing regexp: missing closing ): `(`",
+		"ports:\n        - http":                           `app web: invalid port "http" in checks, expected a port such as 8080/tcp`,
+	} {
+		errs := validateSimple(`
+web:
+  image: harbur/test_web
+  checks:
+      ` + data + `
+`)
+		if assert.Len(t, errs, 1, data) {
+			assert.Equal(t, message, errs[0].Message)
+		}
+	}
+}
+
+func TestRunChecks(t *testing.T) {
+	fake := NewFakeDocker("harbur/web:latest")
+	fake.Configs = map[string]ImageConfig{"harbur/web:latest": {
+		User:   "app:app",
+		Env:    []string{"PATH=/bin", "NODE_ENV=development"},
+		Labels: map[string]string{"team": "platform"},
+		Ports:  []string{"8080/tcp"},
+	}}
+	fake.Files = map[string]map[string]os.FileMode{"harbur/web:latest": {
+		"/app/server": 0755,
+		"/app/config": 0600,
+	}}
+	fake.Run = func(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stdout, "v1.2.3\n")
+		return 0, nil
+	}
+
+	app := App{
+		Name:  "web",
+		Image: "harbur/web",
+		Checks: Checks{
+			Files: []FileCheck{
+				{Path: "/app/server", Mode: "0755"},
+				{Path: "/app/config", Mode: "0644"},
+				{Path: "/app/missing"},
+			},
+			Commands: []CommandCheck{
+				{Command: []string{"/app/server", "--version"}, Output: `^v\d+\.`},
+				{Command: []string{"/app/server", "--version"}, Output: `^2\.`},
+				{Command: []string{"/app/server", "--fail"}, Exit_code: 2},
+			},
+			Non_root: true,
+			Env:      map[string]string{"NODE_ENV": "production", "PATH": "/bin"},
+			Labels:   map[string]string{"team": "platform", "owner": "me"},
+			Ports:    []string{"8080", "9090/tcp"},
+		},
+		Test: []TestCommand{{Shell: "true"}},
+		out:  ioutil.Discard,
+	}
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+
+	results := testApp(context.Background(), opts, app, "harbur/web:latest")
+	failures := make(map[string]string)
+	for _, result := range results {
+		failures[result.Command] = result.Failure
+	}
+	assert.Equal(t, map[string]string{
+		"check user is not root":               "",
+		"check env NODE_ENV=production":        `env NODE_ENV is "development"`,
+		"check env PATH=/bin":                  "",
+		"check label owner=me":                 "label owner is not set",
+		"check label team=platform":            "",
+		"check port 8080/tcp is exposed":       "",
+		"check port 9090/tcp is exposed":       "port 9090/tcp is not exposed",
+		"check file /app/server has mode 0755": "",
+		"check file /app/config has mode 0644": "/app/config has mode 0600",
+		"check file /app/missing":              "/app/missing does not exist",
+		`check command /app/server --version`:  `output "v1.2.3" does not match "^2\\."`,
+		"check command /app/server --fail":     "exited with status 0 instead of 2: v1.2.3",
+		"true":                                 "a check of the image failed",
+	}, failures)
+	assert.Len(t, results, 14)
+	assert.True(t, results[13].Skipped)
+
+	// Images running as root fail the non_root check
+	fake.Configs["harbur/web:latest"] = ImageConfig{User: "0:0"}
+	results = runChecks(context.Background(), opts, App{Name: "web", Checks: Checks{Non_root: true}, out: ioutil.Discard}, "harbur/web:latest")
+	assert.Equal(t, "the image runs as root", results[0].Failure)
+
+	results = runChecks(context.Background(), opts, App{Name: "web", Checks: Checks{Non_root: true}, out: ioutil.Discard}, "harbur/api:latest")
+	assert.Equal(t, "check image configuration", results[0].Command)
+	assert.Equal(t, "no such image: harbur/api:latest", results[0].Failure)
+}
+
+func TestChecksFailedOnce(t *testing.T) {
+	fake := NewFakeDocker("harbur/web:latest")
+	fake.Configs = map[string]ImageConfig{"harbur/web:latest": {User: "root"}}
+	app := App{
+		Name:   "web",
+		Image:  "harbur/web",
+		Checks: Checks{Non_root: true, Ports: []string{"8080"}},
+		out:    ioutil.Discard,
+	}
+	opts := BuildOptions{
+		Config:     &config{Apps: map[string]App{"web": app}},
+		Keep_going: true,
+		Builder:    fake,
+		Registry:   fake,
+		Runner:     fake,
+	}
+
+	// Several checks fail, the app is reported once
+	assert.EqualError(t, Test(opts), "tests failed for web")
+}
+
+func TestPermBits(t *testing.T) {
+	assert.Equal(t, uint64(0755), permBits(0755))
+	assert.Equal(t, uint64(04755), permBits(0755|os.ModeSetuid))
+	assert.Equal(t, uint64(01777), permBits(0777|os.ModeSticky|os.ModeDir))
+}
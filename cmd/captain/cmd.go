@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/fatih/color"
 	"github.com/harbur/captain"
@@ -18,11 +21,32 @@ type Options struct {
 	config     string
 	filterapps []string
 	tag        string
+	parallel   int
+	builder    string
+
+	// Pass the git metadata as build args and labels
+	git_metadata bool
+
+	// Only process the apps affected by the changes since this git revision
+	changed_since string
+
+	// Options of the test command
+	reports    []string
+	keep_going bool
+
+	// Options of the promote command
+	from string
+	to   string
 
 	// Options to define the docker tags context
 	all_branches bool
 	branch_tags  bool
 	commit_tags  bool
+
+	// Options of the tag policy
+	latest            bool
+	semver            bool
+	sanitize_branches bool
 }
 
 var (
@@ -40,8 +64,12 @@ func handleCmd() {
 		Short: "Builds the docker image(s) of your repository",
 		Long:  `It will build the docker image(s) described on captain.yml in order they appear on file.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			config := captain.NewConfig(options.namespace, options.config, true)
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
 
+			if !filterChanged(config) {
+				return
+			}
 			config.FilterConfig(options.filterapps)
 
 			buildOpts := captain.BuildOptions{
@@ -50,11 +78,15 @@ func handleCmd() {
 				Force:        options.force,
 				All_branches: options.all_branches,
 				Long_sha:     options.long_sha,
+				Tag_policy:   tagPolicy(),
 				Branch_tags:  options.branch_tags,
 				Commit_tags:  options.commit_tags,
+				Parallel:     options.parallel,
+				Backend:      options.builder,
+				Git_metadata: options.git_metadata,
 			}
 
-			captain.Build(buildOpts)
+			exitOnError(captain.Build(buildOpts))
 		},
 	}
 
@@ -63,8 +95,12 @@ func handleCmd() {
 		Short: "Runs the tests",
 		Long:  `It will execute the commands described on test section in order they appear on file.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			config := captain.NewConfig(options.namespace, options.config, true)
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
 
+			if !filterChanged(config) {
+				return
+			}
 			config.FilterConfig(options.filterapps)
 
 			buildOpts := captain.BuildOptions{
@@ -73,13 +109,24 @@ func handleCmd() {
 				Force:        options.force,
 				All_branches: options.all_branches,
 				Long_sha:     options.long_sha,
+				Tag_policy:   tagPolicy(),
 				Branch_tags:  options.branch_tags,
 				Commit_tags:  options.commit_tags,
+				Parallel:     options.parallel,
+				Backend:      options.builder,
+				Git_metadata: options.git_metadata,
+				Reports:      options.reports,
+				Keep_going:   options.keep_going,
 			}
 
 			// Build everything before testing
-			captain.Build(buildOpts)
-			captain.Test(buildOpts)
+			exitOnError(captain.Build(buildOpts))
+
+			ctx, stop := interruptContext()
+			buildOpts.Context = ctx
+			err = captain.Test(buildOpts)
+			stop()
+			exitOnError(err)
 		},
 	}
 
@@ -88,8 +135,12 @@ func handleCmd() {
 		Short: "Pushes the images to remote registry",
 		Long:  `It will push the generated images to the remote registry.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			config := captain.NewConfig(options.namespace, options.config, true)
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
 
+			if !filterChanged(config) {
+				return
+			}
 			config.FilterConfig(options.filterapps)
 
 			buildOpts := captain.BuildOptions{
@@ -98,13 +149,17 @@ func handleCmd() {
 				Force:        options.force,
 				All_branches: options.all_branches,
 				Long_sha:     options.long_sha,
+				Tag_policy:   tagPolicy(),
 				Branch_tags:  options.branch_tags,
 				Commit_tags:  options.commit_tags,
+				Parallel:     options.parallel,
+				Backend:      options.builder,
+				Git_metadata: options.git_metadata,
 			}
 
 			// Build everything before pushing
-			captain.Build(buildOpts)
-			captain.Push(buildOpts)
+			exitOnError(captain.Build(buildOpts))
+			exitOnError(captain.Push(buildOpts))
 		},
 	}
 
@@ -113,8 +168,12 @@ func handleCmd() {
 		Short: "Pulls the images from remote registry",
 		Long:  `It will pull the images from the remote registry.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			config := captain.NewConfig(options.namespace, options.config, true)
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
 
+			if !filterChanged(config) {
+				return
+			}
 			config.FilterConfig(options.filterapps)
 
 			buildOpts := captain.BuildOptions{
@@ -123,11 +182,15 @@ func handleCmd() {
 				Force:        options.force,
 				All_branches: options.all_branches,
 				Long_sha:     options.long_sha,
+				Tag_policy:   tagPolicy(),
 				Branch_tags:  options.branch_tags,
 				Commit_tags:  options.commit_tags,
+				Parallel:     options.parallel,
+				Backend:      options.builder,
+				Git_metadata: options.git_metadata,
 			}
 
-			captain.Pull(buildOpts)
+			exitOnError(captain.Pull(buildOpts))
 		},
 	}
 
@@ -136,7 +199,8 @@ func handleCmd() {
 		Short: "Purges the stale images",
 		Long:  `It will purge the stale images. Stale image is an image that is not the latest of at least one branch.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			config := captain.NewConfig(options.namespace, options.config, true)
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
 
 			config.FilterConfig(options.filterapps)
 
@@ -145,9 +209,59 @@ func handleCmd() {
 				Force:        options.force,
 				All_branches: options.all_branches,
 				Long_sha:     options.long_sha,
+				Tag_policy:   tagPolicy(),
 			}
 
-			captain.Purge(buildOpts)
+			exitOnError(captain.Purge(buildOpts))
+		},
+	}
+
+	var cmdPromote = &cobra.Command{
+		Use:   "promote <app>",
+		Short: "Promotes an image to a release channel",
+		Long:  `It will tag the image of an app pushed from a branch or a commit as a release channel, such as alpha, beta or stable, directly in the remote registry without pulling or rebuilding it.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
+
+			promoteOpts := captain.PromoteOptions{
+				Config:     config,
+				App:        args[0],
+				From:       options.from,
+				To:         options.to,
+				Long_sha:   options.long_sha,
+				Tag_policy: tagPolicy(),
+			}
+
+			exitOnError(captain.Promote(promoteOpts))
+		},
+	}
+
+	var cmdAffected = &cobra.Command{
+		Use:   "affected <revision>",
+		Short: "Lists the apps affected by the changes since a git revision",
+		Long:  `It will list the apps whose context, Dockerfile or watched paths changed since the git revision, including the uncommitted changes, along with the apps that want them.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := captain.NewConfig(options.namespace, options.config, true, options.long_sha)
+			exitOnError(err)
+
+			names, err := captain.Affected(config, args[0])
+			exitOnError(err)
+
+			for _, name := range names {
+				fmt.Println(name)
+			}
+		},
+	}
+
+	var cmdValidate = &cobra.Command{
+		Use:   "validate",
+		Short: "Validates the captain.yml",
+		Long:  `It will check the captain.yml for syntax errors, unknown keys, invalid values, unknown or circular wants, missing Dockerfiles, contexts or targets and invalid image names, reporting each issue with its file, line and column.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			exitOnError(captain.Validate(options.config))
 		},
 	}
 
@@ -189,15 +303,101 @@ It works by reading captain.yaml file which describes how to build, test, push a
 	cmdPush.Flags().BoolVarP(&options.commit_tags, "commit-tags", "c", false, "Push the 'commit' docker tags")
 	cmdPush.Flags().StringVarP(&options.tag, "tag", "t", "", "Tag version")
 
+	for _, cmd := range []*cobra.Command{cmdBuild, cmdTest, cmdPush, cmdPull} {
+		cmd.Flags().IntVarP(&options.parallel, "parallel", "p", 1, "Number of independent apps processed concurrently")
+	}
+
+	for _, cmd := range []*cobra.Command{cmdBuild, cmdTest, cmdPush, cmdPull} {
+		cmd.Flags().StringVar(&options.changed_since, "changed-since", "", "Only process the apps affected by the changes since the git revision")
+	}
+
+	for _, cmd := range []*cobra.Command{cmdBuild, cmdTest, cmdPush} {
+		cmd.Flags().StringVar(&options.builder, "builder", "", "Build backend to use (docker or buildx), overrides the backend of captain.yml")
+		cmd.Flags().BoolVar(&options.git_metadata, "git-metadata", false, "Pass the git commit, branch, tag and build date as build args and OCI labels")
+	}
+
+	for _, cmd := range []*cobra.Command{cmdBuild, cmdTest, cmdPush, cmdPull, cmdPurge} {
+		cmd.Flags().BoolVar(&options.latest, "latest", true, "Tag the last build of each app as latest")
+		cmd.Flags().BoolVar(&options.semver, "semver", false, "Tag the images of semantic version git tags such as v1.2.3 as 1, 1.2 and 1.2.3")
+		cmd.Flags().BoolVar(&options.sanitize_branches, "sanitize-branches", true, "Replace the characters not allowed in tags, such as /, in the branch tags")
+	}
+
+	cmdTest.Flags().StringArrayVar(&options.reports, "report", nil, "Write the test results to a report, as junit=path.xml or json=path (repeatable)")
+	cmdTest.Flags().BoolVar(&options.keep_going, "keep-going", false, "Run the tests of every app before reporting the failures")
+
 	cmdPurge.Flags().BoolVarP(&options.force, "dangling", "d", false, "Remove dangling images")
 
-	captainCmd.AddCommand(cmdBuild, cmdTest, cmdPush, cmdPull, cmdVersion, cmdPurge)
+	cmdPromote.Flags().StringVar(&options.from, "from", "", "Branch or commit whose image is promoted (defaults to the current commit)")
+	cmdPromote.Flags().StringVar(&options.to, "to", "", "Release channel to promote the image to")
+	cmdPromote.Flags().BoolVar(&options.sanitize_branches, "sanitize-branches", true, "Look up the branch tags with the characters not allowed in tags, such as /, replaced")
+
+	captainCmd.AddCommand(cmdBuild, cmdTest, cmdPush, cmdPull, cmdVersion, cmdPurge, cmdPromote, cmdAffected, cmdValidate)
 	if err := captainCmd.Execute(); err != nil {
 		fmt.Print(err.Error())
 		return
 	}
 }
 
+// filterChanged keeps the apps affected by the changes since the
+// --changed-since revision, if given. It returns false when no app is left.
+func filterChanged(config captain.Config) bool {
+	if options.changed_since == "" {
+		return true
+	}
+
+	names, err := captain.Affected(config, options.changed_since)
+	exitOnError(err)
+	if len(names) == 0 {
+		return false
+	}
+	config.FilterConfig(names)
+	return true
+}
+
+// exitOnError terminates the process when err is not nil, using the exit
+// status carried by captain.StatusError when available. A StatusError has
+// already been printed by captain, other errors are printed here.
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	if serr, ok := err.(captain.StatusError); ok {
+		os.Exit(serr.Status())
+	}
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+// interruptContext returns a context canceled on SIGINT or SIGTERM, so that
+// the running tests are stopped and their services torn down. Stop releases
+// the signals.
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupts:
+			fmt.Println("Interrupted, stopping the tests")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(interrupts)
+		cancel()
+	}
+}
+
 func getNamespace() string {
 	return os.Getenv("USER")
 }
+
+// tagPolicy returns the tag policy defined by the options
+func tagPolicy() *captain.TagPolicy {
+	return &captain.TagPolicy{
+		Latest:   options.latest,
+		Semver:   options.semver,
+		Sanitize: options.sanitize_branches,
+	}
+}
@@ -1,23 +1,25 @@
 package captain // import "github.com/harbur/captain"
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/harbur/captain/pkg/depgraph"
-	yaml "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
 )
 
 // Config represents the information stored at captain.yml. It keeps information about images and unit tests.
 type Config interface {
 	FilterConfig(filter []string) bool
 	GetApp(app string) App
-	GetApps() []App
+	GetApps() ([]App, error)
+	GetAppLayers() ([][]App, error)
 	GetPath() string
 }
 
@@ -35,20 +37,75 @@ type build struct {
 type config struct {
 	Apps map[string]App `yaml:",inline"`
 	Path string         `yaml:"-"`
+
+	// order holds the app names in the order they appear on file
+	order []string
 }
 
-//var configOrder *yaml.MapSlice
+func (c *config) UnmarshalYAML(value *yaml.Node) error {
+	if err := value.Decode(&c.Apps); err != nil {
+		return err
+	}
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			c.order = append(c.order, value.Content[i].Value)
+		}
+	}
+	return nil
+}
+
+// names returns the app names in the order they appear on file. Apps
+// without a known position come last, sorted by name.
+func (c *config) names() []string {
+	var names []string
+	known := make(map[string]bool)
+	for _, name := range c.order {
+		if _, ok := c.Apps[name]; ok && !known[name] {
+			known[name] = true
+			names = append(names, name)
+		}
+	}
+
+	var unknown []string
+	for name := range c.Apps {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return append(names, unknown...)
+}
 
 // App struct
 type App struct {
-	Build     string            `yaml:"build"`
-	Image     string            `yaml:"image"`
-	Context   string            `yaml:"context,omitempty"`
-	Pre       []string          `yaml:"pre,omitempty"`
-	Post      []string          `yaml:"post,omitempty"`
-	Test      []string          `yaml:"test,omitempty"`
-	Wants     []string          `yaml:"wants,omitempty"`
-	Build_arg map[string]string `yaml:"build_arg,omitempty"`
+	Name             string             `yaml:"-"`
+	Build            string             `yaml:"build"`
+	Image            string             `yaml:"image"`
+	Context          string             `yaml:"context,omitempty"`
+	Pre              []string           `yaml:"pre,omitempty"`
+	Post             []string           `yaml:"post,omitempty"`
+	Test             []TestCommand      `yaml:"test,omitempty"`
+	Wants            []string           `yaml:"wants,omitempty"`
+	Build_arg        map[string]string  `yaml:"build_arg,omitempty"`
+	Backend          string             `yaml:"backend,omitempty"`
+	Target           string             `yaml:"target,omitempty"`
+	Platforms        []string           `yaml:"platforms,omitempty"`
+	Cache_from       []string           `yaml:"cache_from,omitempty"`
+	Cache_to         []string           `yaml:"cache_to,omitempty"`
+	Watch            []string           `yaml:"watch,omitempty"`
+	Max_context_size string             `yaml:"max_context_size,omitempty"`
+	Labels           map[string]string  `yaml:"labels,omitempty"`
+	Annotations      map[string]string  `yaml:"annotations,omitempty"`
+	Tags             []string           `yaml:"tags,omitempty"`
+	Services         map[string]Service `yaml:"services,omitempty"`
+	Checks           Checks             `yaml:"checks,omitempty"`
+	Smoke            *Smoke             `yaml:"smoke,omitempty"`
+
+	// out receives the output of the commands run for the app
+	out io.Writer
+
+	// labels are added by captain to the image of the app
+	labels map[string]string
 }
 
 func (a *App) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -62,6 +119,35 @@ func (a *App) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// withLabel returns a copy of the app whose image gets the label.
+func (a App) withLabel(key, value string) App {
+	labels := map[string]string{key: value}
+	for k, v := range a.labels {
+		if k != key {
+			labels[k] = v
+		}
+	}
+	a.labels = labels
+	return a
+}
+
+// stdout returns the writer the output of the app is sent to.
+func (a App) stdout() io.Writer {
+	if a.out == nil {
+		return os.Stdout
+	}
+	return a.out
+}
+
+// stderr returns the writer the errors of the app are sent to. When the
+// output of the app is redirected, the errors are sent along with it.
+func (a App) stderr() io.Writer {
+	if a.out == nil {
+		return os.Stderr
+	}
+	return a.out
+}
+
 // configFile returns the file to read the config from.
 // If the --config option was given,
 // it will only use the given file.
@@ -74,71 +160,68 @@ func configFile(path string) string {
 
 // readConfig will read the config file
 // and return the created config.
-func readConfig(filename string) *config {
+// longSha selects the long commit SHA as CAPTAIN_REV.
+func readConfig(filename string, longSha bool) (*config, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
-		panic(StatusError{err, 74})
+		pError(err.Error())
+		return nil, StatusError{err, IOFailed}
 	}
-	conf := unmarshal(data)
-	conf.Path = filepath.Dir(filename)
-	return conf
-}
-
-// displaySyntaxError will display more information
-// such as line and error type given an error and
-// the data that was unmarshalled.
-// Thanks to https://github.com/markpeek/packer/commit/5bf33a0e91b2318a40c42e9bf855dcc8dd4cdec5
-func displaySyntaxError(data []byte, syntaxError error) (err error) {
-	syntax, ok := syntaxError.(*json.SyntaxError)
-	if !ok {
-		err = syntaxError
-		return
+	conf, err := unmarshal(filename, data, longSha)
+	if err != nil {
+		return nil, err
 	}
-	newline := []byte{'\x0a'}
-	space := []byte{' '}
-
-	start, end := bytes.LastIndex(data[:syntax.Offset], newline)+1, len(data)
-	if idx := bytes.Index(data[start:], newline); idx >= 0 {
-		end = start + idx
+	conf.Path = filepath.Dir(filename)
+	for name, app := range conf.Apps {
+		app.Name = name
+		conf.Apps[name] = app
 	}
-
-	line, pos := bytes.Count(data[:start], newline)+1, int(syntax.Offset)-start-1
-
-	err = fmt.Errorf("\nError in line %d: %s \n%s\n%s^", line, syntaxError, data[start:end], bytes.Repeat(space, pos))
-	return
+	return conf, nil
 }
 
-// unmarshal converts either JSON
-// or YAML into a config object.
-func unmarshal(data []byte) *config {
+// unmarshal converts YAML into a config object.
+// Syntax errors, unknown keys, invalid values and undefined variables
+// are reported with their position in filename.
+func unmarshal(filename string, data []byte, longSha bool) (*config, error) {
 	var configV1 *configV1
 	_ = yaml.Unmarshal(data, &configV1)
-	if len(configV1.Build.Images) > 0 {
+	if configV1 != nil && len(configV1.Build.Images) > 0 {
 		pError("Old %s format detected! Please check the https://github.com/harbur/captain how to upgrade", "captain.yml")
-		os.Exit(-1)
+		return nil, StatusError{errors.New("old captain.yml format detected"), OldFormat}
 	}
 
-	var config *config
-	err := yaml.Unmarshal(data, &config)
+	root, errs := parseData(filename, data, false, longSha)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			pError(err.Error())
+		}
+		return nil, StatusError{errs, InvalidCaptainYML}
+	}
 
-	if err != nil {
-		err = displaySyntaxError(data, err)
-		pError("%s", err)
-		os.Exit(InvalidCaptainYML)
+	conf := &config{}
+	if len(root.Content) > 0 {
+		if err := root.Decode(conf); err != nil {
+			pError("%s", err)
+			return nil, StatusError{err, InvalidCaptainYML}
+		}
 	}
 
-	return config
+	return conf, nil
 }
 
 // NewConfig returns a new Config instance based on the reading the captain.yml
 // file at path.
 // Containers will be ordered so that they can be
 // brought up and down with Docker.
-func NewConfig(namespace, path string, forceOrder bool) Config {
+// With longSha, CAPTAIN_REV is the long commit SHA.
+func NewConfig(namespace, path string, forceOrder, longSha bool) (Config, error) {
 	var conf *config
 	f := configFile(path)
 	if _, err := os.Stat(f); err == nil {
-		conf = readConfig(f)
+		conf, err = readConfig(f, longSha)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if conf == nil {
@@ -147,38 +230,80 @@ func NewConfig(namespace, path string, forceOrder bool) Config {
 		autoconf.Apps = make(map[string]App)
 		conf = &autoconf
 		dockerfiles := getDockerfiles(namespace)
-		for build, image := range dockerfiles {
-			autoconf.Apps[image] = App{Build: build, Image: image}
+		var builds []string
+		for build := range dockerfiles {
+			builds = append(builds, build)
+		}
+		sort.Strings(builds)
+		for _, build := range builds {
+			image := dockerfiles[build]
+			autoconf.Apps[image] = App{Name: image, Build: build, Image: image}
+			autoconf.order = append(autoconf.order, image)
 		}
 	}
 
-	var err error
+	return conf, nil
+}
 
-	if err != nil {
-		panic(StatusError{err, 78})
+// DependencyError is returned when the wants of the apps cannot be resolved,
+// either because of a circular dependency or an unknown app. Unaffected holds
+// the apps which do not depend on the failing ones.
+type DependencyError struct {
+	Err        error
+	Unaffected []string
+}
+
+func (e *DependencyError) Error() string {
+	msg := e.Err.Error()
+	if err, ok := e.Err.(*depgraph.MissingDependencyError); ok {
+		msg = fmt.Sprintf("app %s wants unknown app %s", err.Name, err.Dependency)
+	}
+	if len(e.Unaffected) == 0 {
+		return msg + " (no app is unaffected)"
 	}
-	return conf
+	return fmt.Sprintf("%s (unaffected apps: %s)", msg, strings.Join(e.Unaffected, ", "))
 }
 
 // GetApps returns a list of Apps
-func (c *config) GetApps() []App {
-	var workingGraph depgraph.Graph
+func (c *config) GetApps() ([]App, error) {
 	var apps []App
 
-	for name, app := range c.Apps {
-		workingGraph = append(workingGraph, depgraph.NewNode(name, app.Wants...))
+	layers, err := c.GetAppLayers()
+	for _, layer := range layers {
+		apps = append(apps, layer...)
 	}
-	graph, err := depgraph.ResolveGraph(workingGraph)
 
-	if err != nil {
-		return apps
-	}
+	return apps, err
+}
 
-	for _, node := range graph {
-		apps = append(apps, c.Apps[node.Name])
+// GetAppLayers returns the Apps grouped in dependency layers. Apps of a layer
+// only want Apps of the previous layers, and keep the order they appear on file.
+//
+// When the wants cannot be resolved, the layers of the unaffected Apps are
+// returned along with a *DependencyError.
+func (c *config) GetAppLayers() ([][]App, error) {
+	var workingGraph depgraph.Graph
+	var layers [][]App
+
+	for _, name := range c.names() {
+		workingGraph = append(workingGraph, depgraph.NewNode(name, c.Apps[name].Wants...))
+	}
+	graph, err := depgraph.ResolveLayers(workingGraph)
+
+	var unaffected []string
+	for _, nodes := range graph {
+		var apps []App
+		for _, node := range nodes {
+			apps = append(apps, c.Apps[node.Name])
+			unaffected = append(unaffected, node.Name)
+		}
+		layers = append(layers, apps)
 	}
 
-	return apps
+	if err != nil {
+		return layers, &DependencyError{Err: err, Unaffected: unaffected}
+	}
+	return layers, nil
 }
 
 func (c *config) FilterConfig(filters []string) bool {
@@ -186,19 +311,34 @@ func (c *config) FilterConfig(filters []string) bool {
 		return true
 	}
 	untouched := true
+	filtered := make(map[string]bool)
 	for name, _ := range c.Apps {
-		filtered := true
+		filtered[name] = true
 		for _, filter := range filters {
 			if name == filter {
-				filtered = false
+				filtered[name] = false
 				break
 			}
 		}
-		if filtered {
+		if filtered[name] {
 			untouched = false
 			delete(c.Apps, name)
 		}
 	}
+
+	// The filtered out apps are not processed, so they are no longer wanted
+	if !untouched {
+		for name, app := range c.Apps {
+			var wants []string
+			for _, want := range app.Wants {
+				if !filtered[want] {
+					wants = append(wants, want)
+				}
+			}
+			app.Wants = wants
+			c.Apps[name] = app
+		}
+	}
 	return untouched
 }
 
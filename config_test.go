@@ -10,6 +10,13 @@ import (
 
 var basedir, _ = os.Getwd()
 
+// apps returns the apps of the config, failing the test on error
+func apps(t *testing.T, c Config) []App {
+	apps, err := c.GetApps()
+	assert.NoError(t, err)
+	return apps
+}
+
 func TestConfigFiles(t *testing.T) {
 	c := configFile("captain.yml")
 	sl := "captain.yml"
@@ -17,49 +24,150 @@ func TestConfigFiles(t *testing.T) {
 }
 
 func TestReadConfig(t *testing.T) {
-	c := readConfig(configFile(path.Join(basedir, "/test/Simple/captain.yml")))
+	c, err := readConfig(configFile(path.Join(basedir, "/test/Simple/captain.yml")), false)
+	assert.NoError(t, err)
 	assert.NotNil(t, c, "Should return configuration")
 }
 
 func TestNewConfig(t *testing.T) {
-	c := NewConfig("", basedir+"/test/Simple/captain.yml", false)
+	c, err := NewConfig("", basedir+"/test/Simple/captain.yml", false, false)
+	assert.NoError(t, err)
 	assert.NotNil(t, c, "Should return captain.yml configuration")
 }
 
 func TestNewConfigInferringValues(t *testing.T) {
-	c := NewConfig("", basedir+"/test/noCaptainYML/captain.yml", false)
+	c, err := NewConfig("", basedir+"/test/noCaptainYML/captain.yml", false, false)
+	assert.NoError(t, err)
 	assert.NotNil(t, c, "Should return infered configuration")
 }
 
 func TestFilterConfigEmpty(t *testing.T) {
-	c := NewConfig("", basedir+"/test/Simple/captain.yml", false)
-	assert.Equal(t, 2, len(c.GetApps()), "Should return 2 apps")
+	c, err := NewConfig("", basedir+"/test/Simple/captain.yml", false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(apps(t, c)), "Should return 2 apps")
 
 	res := c.FilterConfig([]string{})
 	assert.True(t, res, "Should return true")
-	assert.Equal(t, 2, len(c.GetApps()), "Should return 2 apps")
+	assert.Equal(t, 2, len(apps(t, c)), "Should return 2 apps")
 }
 
 func TestFilterConfigNonExistent(t *testing.T) {
-	c := NewConfig("", basedir+"/test/Simple/captain.yml", false)
-	assert.Equal(t, 2, len(c.GetApps()), "Should return 2 apps")
+	c, err := NewConfig("", basedir+"/test/Simple/captain.yml", false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(apps(t, c)), "Should return 2 apps")
 
 	res := c.FilterConfig([]string{"nonexistent"})
 	assert.False(t, res, "Should return false")
-	assert.Equal(t, 0, len(c.GetApps()), "Should return 0 apps")
+	assert.Equal(t, 0, len(apps(t, c)), "Should return 0 apps")
 }
 
 func TestFilterConfigWeb(t *testing.T) {
-	c := NewConfig("", basedir+"/test/Simple/captain.yml", false)
-	assert.Equal(t, 2, len(c.GetApps()), "Should return 2 apps")
+	c, err := NewConfig("", basedir+"/test/Simple/captain.yml", false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(apps(t, c)), "Should return 2 apps")
 
 	c.FilterConfig([]string{"web"})
-	assert.Equal(t, 1, len(c.GetApps()), "Should return 1 app")
+	assert.Equal(t, 1, len(apps(t, c)), "Should return 1 app")
 	assert.Equal(t, "Dockerfile", c.GetApp("web").Build, "Should return web Build field")
 }
 
 func TestGetApp(t *testing.T) {
-	c := NewConfig("", basedir+"/test/Simple/captain.yml", false)
+	c, err := NewConfig("", basedir+"/test/Simple/captain.yml", false, false)
+	assert.NoError(t, err)
 	app := c.GetApp("web")
 	assert.Equal(t, "harbur/test_web", app.Image, "Should return web image")
 }
+
+func TestGetAppLayers(t *testing.T) {
+	c, err := NewConfig("", basedir+"/test/Simple/captain.yml", false, false)
+	assert.NoError(t, err)
+	layers, err := c.GetAppLayers()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(layers), "Should return 1 layer")
+	assert.Equal(t, 2, len(layers[0]), "Should return 2 apps in the layer")
+}
+
+func TestGetAppsCircular(t *testing.T) {
+	c, err := unmarshal("captain.yml", []byte(`
+a:
+  image: harbur/a
+  wants: [b]
+b:
+  image: harbur/b
+  wants: [a]
+c:
+  image: harbur/c
+d:
+  image: harbur/d
+  wants: [a]
+`), false)
+	assert.NoError(t, err)
+
+	apps, err := c.GetApps()
+	assert.IsType(t, &DependencyError{}, err)
+	assert.EqualError(t, err, "circular dependency: a -> b -> a (unaffected apps: c)")
+	assert.Equal(t, 1, len(apps))
+	assert.Equal(t, "harbur/c", apps[0].Image)
+}
+
+func TestGetAppsUnknownWants(t *testing.T) {
+	c, err := unmarshal("captain.yml", []byte(`
+a:
+  image: harbur/a
+  wants: [nonexistent]
+`), false)
+	assert.NoError(t, err)
+
+	_, err = c.GetAppLayers()
+	assert.EqualError(t, err, "app a wants unknown app nonexistent (no app is unaffected)")
+}
+
+func TestFilterConfigWants(t *testing.T) {
+	c, err := unmarshal("captain.yml", []byte(`
+a:
+  image: harbur/a
+b:
+  image: harbur/b
+  wants: [a]
+`), false)
+	assert.NoError(t, err)
+
+	c.FilterConfig([]string{"b"})
+	assert.Equal(t, 1, len(apps(t, c)))
+}
+
+func TestGetAppsOrder(t *testing.T) {
+	c, err := unmarshal("captain.yml", []byte(`
+zeta:
+  image: harbur/zeta
+web:
+  image: harbur/web
+  wants: [base]
+alpha:
+  image: harbur/alpha
+base:
+  image: harbur/base
+backend:
+  image: harbur/backend
+  wants: [base]
+`), false)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		layers, err := c.GetAppLayers()
+		assert.NoError(t, err)
+
+		var order [][]string
+		for _, layer := range layers {
+			var names []string
+			for _, app := range layer {
+				names = append(names, app.Image)
+			}
+			order = append(order, names)
+		}
+		assert.Equal(t, [][]string{
+			{"harbur/zeta", "harbur/alpha", "harbur/base"},
+			{"harbur/web", "harbur/backend"},
+		}, order)
+	}
+}
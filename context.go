@@ -0,0 +1,273 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/pkg/fileutils"
+	units "github.com/docker/go-units"
+)
+
+// contextHashLabel is the image label holding the hash of the build context
+// the image was built from.
+const contextHashLabel = "io.harbur.captain.context-hash"
+
+// dockerignorePatterns returns the exclusion patterns of the context
+// directory. Like BuildKit, a <Dockerfile>.dockerignore file next to the
+// Dockerfile takes precedence over the .dockerignore of the context.
+func dockerignorePatterns(contextDir, dockerfile string) ([]string, error) {
+	for _, name := range []string{
+		filepath.Join(contextDir, dockerfile) + ".dockerignore",
+		filepath.Join(contextDir, ".dockerignore"),
+	} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return dockerignore.ReadAll(f)
+	}
+	return nil, nil
+}
+
+// walkContext calls fn for every file of the context directory that is not
+// excluded by the patterns, in lexical order. The name given to fn is the
+// slash-separated path of the file relative to the context directory.
+func walkContext(contextDir string, excludes []string, fn func(name, path string, info os.FileInfo) error) error {
+	pm, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(contextDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(contextDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		skip, err := pm.Matches(rel)
+		if err != nil {
+			return err
+		}
+		if skip {
+			// Files of the directory may be included again by an exception
+			if info.IsDir() && !pm.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(filepath.ToSlash(rel), path, info)
+	})
+}
+
+// contextHash returns a hash of everything the image of the app is built
+// from: the files of the context not excluded by .dockerignore, the
+// Dockerfile, the target, the platforms, the build args and the labels.
+func contextHash(app App, pathConfig string) (string, error) {
+	h := sha256.New()
+	contextDir := filepath.Join(pathConfig, app.Context)
+
+	fmt.Fprintf(h, "target %q\n", app.Target)
+	fmt.Fprintf(h, "platforms %q\n", app.Platforms)
+
+	var keys []string
+	for k := range app.Build_arg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "build_arg %q %q\n", k, app.Build_arg[k])
+	}
+
+	keys = nil
+	for k := range app.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "label %q %q\n", k, app.Labels[k])
+	}
+
+	if err := hashFile(h, "dockerfile", filepath.Join(contextDir, app.Build)); err != nil {
+		return "", err
+	}
+
+	excludes, err := dockerignorePatterns(contextDir, app.Build)
+	if err != nil {
+		return "", err
+	}
+	err = walkContext(contextDir, excludes, func(name, path string, info os.FileInfo) error {
+		fmt.Fprintf(h, "mode %q %s\n", name, info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "link %q %q\n", name, target)
+		case info.Mode().IsRegular():
+			return hashFile(h, fmt.Sprintf("file %q", name), path)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the size and the content of the file to the hash, after
+// the given header.
+func hashFile(h io.Writer, header string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "%s %d\n", header, info.Size())
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// contextStats returns the number of files and the total size of the build
+// context of the app.
+func contextStats(app App, pathConfig string) (int, int64, error) {
+	contextDir := filepath.Join(pathConfig, app.Context)
+	excludes, err := dockerignorePatterns(contextDir, app.Build)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var files int
+	var size int64
+	err = walkContext(contextDir, excludes, func(name, path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// checkContextSize reports the size of the build context of the app and
+// fails when it exceeds the max_context_size of the app.
+func checkContextSize(app App, pathConfig string) error {
+	files, size, err := contextStats(app, pathConfig)
+	if err != nil {
+		return err
+	}
+	fInfo(app.stdout(), "Build context of %s: %s files, %s", app.Image, strconv.Itoa(files), units.HumanSize(float64(size)))
+
+	if app.Max_context_size == "" {
+		return nil
+	}
+	max, err := units.FromHumanSize(app.Max_context_size)
+	if err != nil {
+		return fmt.Errorf("invalid max_context_size of %s: %s", app.Name, err)
+	}
+	if size > max {
+		return fmt.Errorf("build context of %s is %s, more than the max_context_size of %s - exclude files with .dockerignore",
+			app.Image, units.HumanSize(float64(size)), units.HumanSize(float64(max)))
+	}
+	return nil
+}
+
+// contextTar returns a tar stream of the build context of the app, without
+// the files excluded by the .dockerignore patterns. As with docker, the
+// Dockerfile and the .dockerignore file are always sent.
+func contextTar(app App, pathConfig string) (io.ReadCloser, error) {
+	contextDir := filepath.Join(pathConfig, app.Context)
+	excludes, err := dockerignorePatterns(contextDir, app.Build)
+	if err != nil {
+		return nil, err
+	}
+	forced := map[string]bool{
+		filepath.ToSlash(filepath.Clean(app.Build)): true,
+		".dockerignore": true,
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		add := func(name, path string, info os.FileInfo) error {
+			delete(forced, name)
+			return addToTar(tw, name, path, info)
+		}
+
+		err := walkContext(contextDir, excludes, add)
+		for name := range forced {
+			if err != nil {
+				break
+			}
+			path := filepath.Join(contextDir, filepath.FromSlash(name))
+			if info, statErr := os.Lstat(path); statErr == nil && info.Mode().IsRegular() {
+				err = add(name, path, info)
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func addToTar(tw *tar.Writer, name, path string, info os.FileInfo) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// Keep the archive independent of the local users
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,163 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempContext(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "captain")
+	assert.NoError(t, err)
+	for name, content := range files {
+		writeFile(t, filepath.Join(dir, name), content)
+	}
+	return dir
+}
+
+func TestWalkContext(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile":       "FROM scratch",
+		"src/main.go":      "package main",
+		"node_modules/a":   "a",
+		"logs/a.log":       "a",
+		"logs/keep.log":    "keep",
+		"docs/README.md":   "docs",
+		"docs/CHANGES.txt": "changes",
+	})
+	defer os.RemoveAll(dir)
+
+	var names []string
+	err := walkContext(dir, []string{"node_modules", "logs/*.log", "!logs/keep.log", "**/*.md"}, func(name, path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Dockerfile", "docs/CHANGES.txt", "logs/keep.log", "src/main.go"}, names)
+}
+
+func TestContextHash(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile":    "FROM scratch",
+		".dockerignore": "*.log",
+		"main.go":       "package main",
+	})
+	defer os.RemoveAll(dir)
+
+	app := App{Build: "Dockerfile", Context: ".", Build_arg: map[string]string{"a": "1", "b": "2"}}
+	hash, err := contextHash(app, dir)
+	assert.NoError(t, err)
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", hash)
+
+	same, err := contextHash(app, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, same, "Hash should be deterministic")
+
+	// Ignored files do not change the hash
+	writeFile(t, filepath.Join(dir, "debug.log"), "debug")
+	same, err = contextHash(app, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, same)
+
+	// Build args do
+	app.Build_arg = map[string]string{"a": "1", "b": "3"}
+	changed, err := contextHash(app, dir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+	app.Build_arg = map[string]string{"a": "1", "b": "2"}
+
+	// And so do the files of the context
+	writeFile(t, filepath.Join(dir, "main.go"), "package main // changed")
+	changed, err = contextHash(app, dir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+
+	// And the Dockerfile
+	writeFile(t, filepath.Join(dir, "main.go"), "package main")
+	writeFile(t, filepath.Join(dir, "Dockerfile"), "FROM alpine")
+	changed, err = contextHash(app, dir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changed)
+}
+
+func TestDockerfileDockerignore(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile":                   "FROM scratch",
+		"Dockerfile.test":              "FROM scratch",
+		"Dockerfile.test.dockerignore": "*.go",
+		".dockerignore":                "test",
+		"main.go":                      "package main",
+		"test/main_test.go":            "package main",
+	})
+	defer os.RemoveAll(dir)
+
+	patterns, err := dockerignorePatterns(dir, "Dockerfile")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test"}, patterns)
+
+	patterns, err = dockerignorePatterns(dir, "Dockerfile.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"*.go"}, patterns)
+}
+
+func TestContextTar(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile":    "FROM scratch",
+		".dockerignore": "Dockerfile\n.dockerignore\n*.log",
+		"main.go":       "package main",
+		"debug.log":     "debug",
+		"src/lib.go":    "package src",
+	})
+	defer os.RemoveAll(dir)
+
+	r, err := contextTar(App{Build: "Dockerfile", Context: "."}, dir)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	contents := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, _ := ioutil.ReadAll(tr)
+		contents[hdr.Name] = string(data)
+	}
+	assert.Equal(t, map[string]string{
+		"Dockerfile":    "FROM scratch",
+		".dockerignore": "Dockerfile\n.dockerignore\n*.log",
+		"main.go":       "package main",
+		"src/":          "",
+		"src/lib.go":    "package src",
+	}, contents)
+}
+
+func TestCheckContextSize(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile": "FROM scratch",
+		"data":       strings.Repeat("x", 2000),
+	})
+	defer os.RemoveAll(dir)
+
+	app := App{Name: "web", Image: "harbur/web", Build: "Dockerfile", Context: ".", out: ioutil.Discard}
+	files, size, err := contextStats(app, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(2012), size)
+
+	assert.NoError(t, checkContextSize(app, dir))
+	app.Max_context_size = "1MB"
+	assert.NoError(t, checkContextSize(app, dir))
+	app.Max_context_size = "1kB"
+	assert.EqualError(t, checkContextSize(app, dir), "build context of harbur/web is 2.012kB, more than the max_context_size of 1kB - exclude files with .dockerignore")
+}
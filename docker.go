@@ -1,35 +1,136 @@
 package captain // import "github.com/harbur/captain"
 
 import (
+	"archive/tar"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
 )
 
-var client *docker.Client
+// Builder builds and manages the local images of the apps.
+type Builder interface {
+	BuildImage(app App, tag string, pathConfig string, force bool) error
+	TagImage(app App, origin string, tag string) error
+	RemoveImage(name string) error
+	GetImages(app App) ([]string, error)
+	ImageExist(app App, tag string) bool
 
-func init() {
-	var err error
-	client, err = docker.NewClientFromEnv()
+	// ImageWithLabel returns a tag of the image of the app having the label,
+	// or an empty string if there is none.
+	ImageWithLabel(app App, key, value string) (string, error)
+}
+
+// Registry transfers the images of the apps to and from a remote registry.
+type Registry interface {
+	PushImage(app App, version string) error
+	PullImage(app App, version string) error
+}
+
+// ContainerOptions describes a container run from the image of an app.
+type ContainerOptions struct {
+	Image   string
+	Command []string
+
+	// Env holds the environment variables as KEY=value
+	Env []string
+
+	// Volumes holds the volumes as source:destination[:mode]
+	Volumes []string
+	Workdir string
+
+	// Network is the network the container is attached to, on which it is
+	// reachable by its Aliases.
+	Network string
+	Aliases []string
+
+	// Ports are the ports of the container, such as 8080/tcp, published on
+	// random ports of the Docker host
+	Ports []string
+}
+
+// ContainerState describes a container started by StartContainer.
+type ContainerState struct {
+	Running  bool
+	ExitCode int
+
+	// Health is the status of the HEALTHCHECK of the container: starting,
+	// healthy or unhealthy. It is empty when the image has no HEALTHCHECK.
+	Health string
+
+	// Ports are the ports exposed by the container, such as 5432/tcp, sorted
+	Ports []string
+
+	// Published maps the published ports of the container to their address
+	// on the Docker host, such as 127.0.0.1:32768
+	Published map[string]string
+}
+
+// Runner runs containers from the images of the apps.
+type Runner interface {
+	// RunContainer runs a container until it exits, writing its output to
+	// stdout and stderr, and returns its exit code. The container is killed
+	// once ctx is done, and is always removed.
+	RunContainer(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error)
+
+	// StartContainer starts a container in the background and returns its
+	// id. The image is pulled when missing, its progress written to out.
+	StartContainer(opts ContainerOptions, out io.Writer) (string, error)
+	InspectContainer(id string) (ContainerState, error)
+	ContainerLogs(id string, stdout, stderr io.Writer) error
+
+	// RemoveContainer kills and removes a container started by StartContainer
+	RemoveContainer(id string) error
+
+	CreateNetwork(name string) error
+	RemoveNetwork(name string) error
+
+	InspectImage(image string) (ImageConfig, error)
+
+	// FileMode returns the mode of the file at path in the image. The error
+	// satisfies os.IsNotExist when there is no such file.
+	FileMode(image, path string) (os.FileMode, error)
+}
+
+// DockerBackend implements Builder, Registry and Runner using the Docker
+// daemon.
+type DockerBackend struct {
+	client *docker.Client
+}
+
+// NewDockerBackend returns a DockerBackend configured from the DOCKER_*
+// environment variables.
+func NewDockerBackend() (*DockerBackend, error) {
+	client, err := docker.NewClientFromEnv()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return &DockerBackend{client: client}, nil
 }
 
 type BuildArgSet struct {
 	slice []docker.BuildArg
 }
 
-func buildImage(app App, tag string, pathConfig string, force bool) error {
-	pInfo("Building image %s:%s", app.Image, tag)
+func (d *DockerBackend) BuildImage(app App, tag string, pathConfig string, force bool) error {
+	out := app.stdout()
+	fInfo(out, "Building image %s:%s", app.Image, tag)
 
 	// Nasty issue with CircleCI https://github.com/docker/docker/issues/4897
 	if os.Getenv("CIRCLECI") == "true" {
-		pInfo("Running at %s environment...", "CIRCLECI")
-		return execute("docker", "build", "-t", app.Image+":"+tag, filepath.Dir(app.Build))
+		fInfo(out, "Running at %s environment...", "CIRCLECI")
+		args := append([]string{"build", "-t", app.Image + ":" + tag}, labelFlags(app.labels)...)
+		return executeWithOutput(out, "docker", append(args, filepath.Dir(app.Build))...)
 	}
 
 	// Create BuildArg set
@@ -40,8 +141,8 @@ func buildImage(app App, tag string, pathConfig string, force bool) error {
 		}
 	}
 	contextDir := path.Join(pathConfig, app.Context)
-	pInfo(contextDir)
-	pInfo(path.Join(pathConfig, app.Build))
+	fInfo(out, contextDir)
+	fInfo(out, path.Join(pathConfig, app.Build))
 	Dockerfile := app.Build
 
 	opts := docker.BuildImageOptions{
@@ -51,67 +152,418 @@ func buildImage(app App, tag string, pathConfig string, force bool) error {
 		SuppressOutput:      false,
 		RmTmpContainer:      true,
 		ForceRmTmpContainer: true,
-		OutputStream:        os.Stdout,
-		ContextDir:          contextDir,
+		OutputStream:        out,
 		BuildArgs:           buildArgSet.slice,
+		Labels:              app.labels,
+	}
+
+	// Use the registry credentials of the environment and ~/.docker/
+	authConfigs, err := resolveAuthConfigs(out)
+	if err != nil {
+		fError(out, "%s", err)
+		return err
+	}
+	opts.AuthConfigs = authConfigs
+
+	if !force {
+		opts.CacheFrom = d.cacheFrom(app)
+	}
+	if len(app.Cache_to) > 0 {
+		fInfo(out, "Ignoring cache_to of %s - only supported by the %s backend", app.Image, BackendBuildkit)
+	}
+	if len(app.Annotations) > 0 {
+		fInfo(out, "Ignoring annotations of %s - only supported by the %s backend", app.Image, BackendBuildkit)
+	}
+
+	// Send the context honoring the .dockerignore of the Dockerfile
+	context, err := contextTar(app, pathConfig)
+	if err != nil {
+		fError(out, "%s", err)
+		return err
 	}
+	defer context.Close()
+	opts.InputStream = context
 
-	// Use ~/.docker/ auth configuration if exists
-	dockercfg, _ := docker.NewAuthConfigurationsFromDockerCfg()
-	if dockercfg != nil {
-		opts.AuthConfigs = *dockercfg
+	// The API of the client does not support build targets, rely on the CLI
+	if app.Target != "" {
+		return executeWithInput(context, out, "docker", dockerBuildArgs(opts, app.Target)...)
 	}
 
-	if err := client.BuildImage(opts); err != nil {
-		pError("%s", err)
+	if err := d.client.BuildImage(opts); err != nil {
+		fError(out, "%s", err)
 		return err
 	}
 
 	return nil
 }
 
-func pushImage(image string, version string) error {
-	return execute("docker", "push", image+":"+version)
+// dockerBuildArgs returns the docker CLI arguments equivalent to the build
+// options, building the target stage. The context is read from stdin.
+func dockerBuildArgs(opts docker.BuildImageOptions, target string) []string {
+	args := []string{"build",
+		"--tag", opts.Name,
+		"--file", opts.Dockerfile,
+		"--target", target,
+	}
+	if opts.NoCache {
+		args = append(args, "--no-cache")
+	}
+	for _, ref := range opts.CacheFrom {
+		args = append(args, "--cache-from", ref)
+	}
+
+	var buildArgs []string
+	for _, arg := range opts.BuildArgs {
+		buildArgs = append(buildArgs, arg.Name+"="+arg.Value)
+	}
+	sort.Strings(buildArgs)
+	for _, arg := range buildArgs {
+		args = append(args, "--build-arg", arg)
+	}
+	args = append(args, labelFlags(opts.Labels)...)
+
+	return append(args, "-")
+}
+
+// labelFlags returns the docker CLI flags adding the labels, sorted.
+func labelFlags(labels map[string]string) []string {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var flags []string
+	for _, k := range keys {
+		flags = append(flags, "--label", k+"="+labels[k])
+	}
+	return flags
 }
 
-func pullImage(image string, version string) error {
-	return execute("docker", "pull", image+":"+version)
+// cacheFrom returns the images of the app usable as cache by the daemon,
+// pulling the ones that are missing locally.
+func (d *DockerBackend) cacheFrom(app App) []string {
+	out := app.stdout()
+
+	var images []string
+	for _, ref := range app.Cache_from {
+		if isLocalCache(ref) || isRawCache(ref) {
+			fInfo(out, "Ignoring cache %s of %s - only supported by the %s backend", ref, app.Image, BackendBuildkit)
+			continue
+		}
+
+		if image, _ := d.client.InspectImage(ref); image == nil {
+			fDebug(out, "Pulling cache image %s", ref)
+			repo, tag := docker.ParseRepositoryTag(ref)
+			auth, err := resolveAuth(repo)
+			if err != nil {
+				fDebug(out, "Skipping cache image %s: %s", ref, err)
+				continue
+			}
+			opts := docker.PullImageOptions{Repository: repo, Tag: tag, OutputStream: ioutil.Discard}
+			if err := d.client.PullImage(opts, auth); err != nil {
+				fDebug(out, "Skipping cache image %s: %s", ref, err)
+				continue
+			}
+		}
+		images = append(images, ref)
+	}
+	return images
 }
 
-func tagImage(app App, origin string, tag string) error {
+func (d *DockerBackend) PushImage(app App, version string) error {
+	auth, err := resolveAuth(app.Image)
+	if err != nil {
+		return err
+	}
+	opts := docker.PushImageOptions{Name: app.Image, Tag: version, OutputStream: app.stdout()}
+	return d.client.PushImage(opts, auth)
+}
+
+func (d *DockerBackend) PullImage(app App, version string) error {
+	auth, err := resolveAuth(app.Image)
+	if err != nil {
+		return err
+	}
+	opts := docker.PullImageOptions{Repository: app.Image, Tag: version, OutputStream: app.stdout()}
+	return d.client.PullImage(opts, auth)
+}
+
+func (d *DockerBackend) TagImage(app App, origin string, tag string) error {
 	if tag != "" {
-		pInfo("Tagging image %s:%s as %s:%s", app.Image, origin, app.Image, tag)
+		fInfo(app.stdout(), "Tagging image %s:%s as %s:%s", app.Image, origin, app.Image, tag)
 		opts := docker.TagImageOptions{Repo: app.Image, Tag: tag, Force: true}
-		err := client.TagImage(app.Image+":"+origin, opts)
+		err := d.client.TagImage(app.Image+":"+origin, opts)
 		if err != nil {
-			fmt.Printf("%s", err)
+			fmt.Fprintf(app.stdout(), "%s", err)
 		}
 		return err
 	}
 
-	pDebug("Skipping tag of %s - no git repository", app.Image)
+	fDebug(app.stdout(), "Skipping tag of %s - no git repository", app.Image)
 
 	return nil
 }
 
-func removeImage(name string) error {
-	return client.RemoveImage(name)
+func (d *DockerBackend) RemoveImage(name string) error {
+	return d.client.RemoveImage(name)
 }
 
-/**
- * Retrieves a list of existing Images for the specific App.
- */
-func getImages(app App) []docker.APIImages {
-	pDebug("Getting images %s", app.Image)
-	imgs, _ := client.ListImages(docker.ListImagesOptions{All: false, Filter: app.Image})
-	return imgs
+// GetImages retrieves the tags of the existing Images for the specific App.
+func (d *DockerBackend) GetImages(app App) ([]string, error) {
+	fDebug(app.stdout(), "Getting images %s", app.Image)
+	imgs, err := d.client.ListImages(docker.ListImagesOptions{All: false, Filter: app.Image})
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, img := range imgs {
+		tags = append(tags, img.RepoTags...)
+	}
+	return tags, nil
 }
 
-func imageExist(app App, tag string) bool {
+func (d *DockerBackend) ImageExist(app App, tag string) bool {
 	repo := app.Image + ":" + tag
-	image, _ := client.InspectImage(repo)
+	image, _ := d.client.InspectImage(repo)
 	if image != nil {
 		return true
 	}
 	return false
 }
+
+func (d *DockerBackend) ImageWithLabel(app App, key, value string) (string, error) {
+	imgs, err := d.client.ListImages(docker.ListImagesOptions{
+		Filters: map[string][]string{
+			"reference": {app.Image},
+			"label":     {key + "=" + value},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var tags []string
+	for _, img := range imgs {
+		for _, ref := range img.RepoTags {
+			if strings.HasPrefix(ref, app.Image+":") {
+				tags = append(tags, strings.TrimPrefix(ref, app.Image+":"))
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return "", nil
+	}
+	sort.Strings(tags)
+	return tags[0], nil
+}
+
+// createContainer creates the container, pulling its image when missing.
+func (d *DockerBackend) createContainer(opts ContainerOptions, out io.Writer) (*docker.Container, error) {
+	create := docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image:      opts.Image,
+			Cmd:        opts.Command,
+			Env:        opts.Env,
+			WorkingDir: opts.Workdir,
+		},
+		HostConfig: &docker.HostConfig{Binds: opts.Volumes},
+	}
+	if len(opts.Ports) > 0 {
+		create.Config.ExposedPorts = make(map[docker.Port]struct{})
+		create.HostConfig.PortBindings = make(map[docker.Port][]docker.PortBinding)
+		for _, port := range opts.Ports {
+			create.Config.ExposedPorts[docker.Port(port)] = struct{}{}
+			create.HostConfig.PortBindings[docker.Port(port)] = []docker.PortBinding{{}}
+		}
+	}
+	if opts.Network != "" {
+		create.HostConfig.NetworkMode = opts.Network
+		create.NetworkingConfig = &docker.NetworkingConfig{
+			EndpointsConfig: map[string]*docker.EndpointConfig{
+				opts.Network: {Aliases: opts.Aliases},
+			},
+		}
+	}
+
+	container, err := d.client.CreateContainer(create)
+	if err != docker.ErrNoSuchImage {
+		return container, err
+	}
+
+	repository, tag := docker.ParseRepositoryTag(opts.Image)
+	auth, err := resolveAuth(repository)
+	if err != nil {
+		return nil, err
+	}
+	pull := docker.PullImageOptions{Repository: repository, Tag: tag, OutputStream: out}
+	if err := d.client.PullImage(pull, auth); err != nil {
+		return nil, err
+	}
+	return d.client.CreateContainer(create)
+}
+
+func (d *DockerBackend) RunContainer(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+	container, err := d.createContainer(opts, stdout)
+	if err != nil {
+		return -1, err
+	}
+	defer func() {
+		if err := d.RemoveContainer(container.ID); err != nil {
+			fDebug(stdout, "Could not remove container %s: %s", container.ID, err)
+		}
+	}()
+
+	if err := d.client.StartContainerWithContext(container.ID, nil, ctx); err != nil {
+		return -1, err
+	}
+
+	err = d.client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    container.ID,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Follow:       true,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil && ctx.Err() == nil {
+		fDebug(stdout, "Could not follow the output of container %s: %s", container.ID, err)
+	}
+
+	return d.client.WaitContainerWithContext(container.ID, ctx)
+}
+
+func (d *DockerBackend) StartContainer(opts ContainerOptions, out io.Writer) (string, error) {
+	container, err := d.createContainer(opts, out)
+	if err != nil {
+		return "", err
+	}
+	if err := d.client.StartContainer(container.ID, nil); err != nil {
+		d.RemoveContainer(container.ID)
+		return "", err
+	}
+	return container.ID, nil
+}
+
+func (d *DockerBackend) InspectContainer(id string) (ContainerState, error) {
+	container, err := d.client.InspectContainer(id)
+	if err != nil {
+		return ContainerState{}, err
+	}
+
+	state := ContainerState{
+		Running:  container.State.Running,
+		ExitCode: container.State.ExitCode,
+		Health:   container.State.Health.Status,
+	}
+	if container.Config != nil {
+		for port := range container.Config.ExposedPorts {
+			state.Ports = append(state.Ports, string(port))
+		}
+		sort.Strings(state.Ports)
+	}
+	if container.NetworkSettings != nil {
+		for port, bindings := range container.NetworkSettings.Ports {
+			if len(bindings) == 0 {
+				continue
+			}
+			if state.Published == nil {
+				state.Published = make(map[string]string)
+			}
+			host := bindings[0].HostIP
+			if host == "" || host == "0.0.0.0" || host == "::" {
+				host = d.host()
+			}
+			state.Published[string(port)] = net.JoinHostPort(host, bindings[0].HostPort)
+		}
+	}
+	return state, nil
+}
+
+// host returns the address of the Docker host: the host of DOCKER_HOST when
+// the daemon is remote, the loopback address otherwise.
+func (d *DockerBackend) host() string {
+	if u, err := url.Parse(d.client.Endpoint()); err == nil {
+		switch u.Scheme {
+		case "tcp", "http", "https":
+			if host := u.Hostname(); host != "" {
+				return host
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+func (d *DockerBackend) ContainerLogs(id string, stdout, stderr io.Writer) error {
+	return d.client.Logs(docker.LogsOptions{
+		Container:    id,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Stdout:       true,
+		Stderr:       true,
+	})
+}
+
+func (d *DockerBackend) RemoveContainer(id string) error {
+	return d.client.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true, RemoveVolumes: true})
+}
+
+func (d *DockerBackend) CreateNetwork(name string) error {
+	_, err := d.client.CreateNetwork(docker.CreateNetworkOptions{Name: name, Driver: "bridge", CheckDuplicate: true})
+	return err
+}
+
+func (d *DockerBackend) RemoveNetwork(name string) error {
+	return d.client.RemoveNetwork(name)
+}
+
+func (d *DockerBackend) InspectImage(image string) (ImageConfig, error) {
+	img, err := d.client.InspectImage(image)
+	if err != nil {
+		return ImageConfig{}, err
+	}
+
+	var config ImageConfig
+	if img.Config != nil {
+		config = ImageConfig{User: img.Config.User, Env: img.Config.Env, Labels: img.Config.Labels}
+		for port := range img.Config.ExposedPorts {
+			config.Ports = append(config.Ports, string(port))
+		}
+		sort.Strings(config.Ports)
+	}
+	return config, nil
+}
+
+func (d *DockerBackend) FileMode(image, path string) (os.FileMode, error) {
+	// The container is never started, the command only makes the creation
+	// succeed for images without one.
+	container, err := d.client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: image, Cmd: []string{"captain-check"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer d.RemoveContainer(container.ID)
+
+	// Only the header of the first entry of the archive is read
+	pr, pw := io.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		err := d.client.DownloadFromContainer(container.ID, docker.DownloadFromContainerOptions{OutputStream: pw, Path: path})
+		pw.CloseWithError(err)
+		errc <- err
+	}()
+	header, err := tar.NewReader(pr).Next()
+	pr.Close()
+	downloadErr := <-errc
+
+	if err != nil {
+		if derr, ok := downloadErr.(*docker.Error); ok && derr.Status == http.StatusNotFound {
+			return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		}
+		return 0, err
+	}
+	return header.FileInfo().Mode(), nil
+}
@@ -0,0 +1,313 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeDocker is an in-memory implementation of Builder, Registry and Runner.
+// It keeps track of the images it knows about and of every operation
+// performed, so that the tagging lifecycle can be verified without a Docker
+// daemon.
+type FakeDocker struct {
+	mu sync.Mutex
+
+	// images maps an image reference (image:tag) to an image id
+	images map[string]string
+	nextID int
+
+	// labels maps an image id to its labels
+	labels map[string]map[string]string
+
+	// containers maps the id of the containers started by StartContainer to
+	// their options
+	containers map[string]ContainerOptions
+
+	// Networks holds the networks which exist
+	Networks map[string]bool
+
+	// Built, Pushed, Pulled and Removed record the image references of each
+	// operation, in order.
+	Built   []string
+	Pushed  []string
+	Pulled  []string
+	Removed []string
+
+	// Ran records the containers run, in order
+	Ran []ContainerOptions
+
+	// Started and Stopped record the containers started in the background and
+	// removed, in order
+	Started []ContainerOptions
+	Stopped []ContainerOptions
+
+	// BuildErr, when set, is returned by BuildImage
+	BuildErr error
+
+	// Run, when set, is called by RunContainer for the exit code of the
+	// container. Containers exit with 0 otherwise.
+	Run func(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error)
+
+	// Configs holds the configurations of the images by reference, and
+	// Files the modes of their files by path
+	Configs map[string]ImageConfig
+	Files   map[string]map[string]os.FileMode
+
+	// State, when set, is called by InspectContainer for the state of a
+	// started container. Containers are running otherwise.
+	State func(opts ContainerOptions) ContainerState
+}
+
+// NewFakeDocker returns a FakeDocker knowing about the given image references.
+func NewFakeDocker(refs ...string) *FakeDocker {
+	f := &FakeDocker{
+		images:     make(map[string]string),
+		labels:     make(map[string]map[string]string),
+		containers: make(map[string]ContainerOptions),
+		Networks:   make(map[string]bool),
+	}
+	for _, ref := range refs {
+		f.images[ref] = f.newID()
+	}
+	return f
+}
+
+func (f *FakeDocker) newID() string {
+	f.nextID++
+	return fmt.Sprintf("sha256:%064d", f.nextID)
+}
+
+// Tags returns the tags known for the image, sorted.
+func (f *FakeDocker) Tags(image string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var tags []string
+	for ref := range f.images {
+		if strings.HasPrefix(ref, image+":") {
+			tags = append(tags, strings.TrimPrefix(ref, image+":"))
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (f *FakeDocker) BuildImage(app App, tag string, pathConfig string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.BuildErr != nil {
+		return f.BuildErr
+	}
+	ref := app.Image + ":" + tag
+	id := f.newID()
+	f.images[ref] = id
+	f.labels[id] = app.labels
+	f.Built = append(f.Built, ref)
+	return nil
+}
+
+func (f *FakeDocker) TagImage(app App, origin string, tag string) error {
+	if tag == "" {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, ok := f.images[app.Image+":"+origin]
+	if !ok {
+		return fmt.Errorf("no such image: %s:%s", app.Image, origin)
+	}
+	f.images[app.Image+":"+tag] = id
+	return nil
+}
+
+func (f *FakeDocker) RemoveImage(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.images[name]; !ok {
+		return fmt.Errorf("no such image: %s", name)
+	}
+	delete(f.images, name)
+	f.Removed = append(f.Removed, name)
+	return nil
+}
+
+func (f *FakeDocker) GetImages(app App) ([]string, error) {
+	var refs []string
+	for _, tag := range f.Tags(app.Image) {
+		refs = append(refs, app.Image+":"+tag)
+	}
+	return refs, nil
+}
+
+func (f *FakeDocker) ImageExist(app App, tag string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.images[app.Image+":"+tag]
+	return ok
+}
+
+func (f *FakeDocker) ImageWithLabel(app App, key, value string) (string, error) {
+	for _, tag := range f.Tags(app.Image) {
+		f.mu.Lock()
+		labels := f.labels[f.images[app.Image+":"+tag]]
+		f.mu.Unlock()
+		if v, ok := labels[key]; ok && v == value {
+			return tag, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *FakeDocker) PushImage(app App, version string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ref := app.Image + ":" + version
+	if _, ok := f.images[ref]; !ok {
+		return fmt.Errorf("no such image: %s", ref)
+	}
+	f.Pushed = append(f.Pushed, ref)
+	return nil
+}
+
+func (f *FakeDocker) PullImage(app App, version string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ref := app.Image + ":" + version
+	if _, ok := f.images[ref]; !ok {
+		f.images[ref] = f.newID()
+	}
+	f.Pulled = append(f.Pulled, ref)
+	return nil
+}
+
+func (f *FakeDocker) RunContainer(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+	f.mu.Lock()
+	_, ok := f.images[opts.Image]
+	f.Ran = append(f.Ran, opts)
+	run := f.Run
+	f.mu.Unlock()
+
+	if !ok {
+		return -1, fmt.Errorf("no such image: %s", opts.Image)
+	}
+	if run == nil {
+		return 0, nil
+	}
+	return run(ctx, opts, stdout, stderr)
+}
+
+func (f *FakeDocker) StartContainer(opts ContainerOptions, out io.Writer) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if opts.Network != "" && !f.Networks[opts.Network] {
+		return "", fmt.Errorf("no such network: %s", opts.Network)
+	}
+	id := f.newID()
+	f.containers[id] = opts
+	f.Started = append(f.Started, opts)
+	return id, nil
+}
+
+func (f *FakeDocker) InspectContainer(id string) (ContainerState, error) {
+	f.mu.Lock()
+	opts, ok := f.containers[id]
+	state := f.State
+	f.mu.Unlock()
+
+	if !ok {
+		return ContainerState{}, fmt.Errorf("no such container: %s", id)
+	}
+	if state == nil {
+		return ContainerState{Running: true}, nil
+	}
+	return state(opts), nil
+}
+
+func (f *FakeDocker) ContainerLogs(id string, stdout, stderr io.Writer) error {
+	f.mu.Lock()
+	opts, ok := f.containers[id]
+	f.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+	fmt.Fprintf(stdout, "logs of %s\n", opts.Image)
+	return nil
+}
+
+func (f *FakeDocker) RemoveContainer(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	opts, ok := f.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+	delete(f.containers, id)
+	f.Stopped = append(f.Stopped, opts)
+	return nil
+}
+
+func (f *FakeDocker) CreateNetwork(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Networks[name] {
+		return fmt.Errorf("network %s already exists", name)
+	}
+	f.Networks[name] = true
+	return nil
+}
+
+func (f *FakeDocker) RemoveNetwork(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.Networks[name] {
+		return fmt.Errorf("no such network: %s", name)
+	}
+	for _, opts := range f.containers {
+		if opts.Network == name {
+			return fmt.Errorf("network %s has active endpoints", name)
+		}
+	}
+	delete(f.Networks, name)
+	return nil
+}
+
+func (f *FakeDocker) InspectImage(image string) (ImageConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.images[image]; !ok {
+		return ImageConfig{}, fmt.Errorf("no such image: %s", image)
+	}
+	return f.Configs[image], nil
+}
+
+func (f *FakeDocker) FileMode(image, path string) (os.FileMode, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.images[image]; !ok {
+		return 0, fmt.Errorf("no such image: %s", image)
+	}
+	mode, ok := f.Files[image][path]
+	if !ok {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return mode, nil
+}
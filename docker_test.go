@@ -6,49 +6,93 @@ import (
 
 	"os"
 
+	docker "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
 )
 
+// newTestDockerBackend returns a DockerBackend, skipping the test when no
+// Docker daemon is reachable.
+func newTestDockerBackend(t *testing.T) *DockerBackend {
+	d, err := NewDockerBackend()
+	if err != nil {
+		t.Skipf("Docker is not configured: %s", err)
+	}
+	if err := d.client.Ping(); err != nil {
+		t.Skipf("Docker daemon is not reachable: %s", err)
+	}
+	return d
+}
+
 func TestBuildImage(t *testing.T) {
+	d := newTestDockerBackend(t)
 	app := App{Build: "Dockerfile", Image: "captain_test"}
-	res := buildImage(app, "latest", path.Join(basedir, "test/noCaptainYML"), false)
+	res := d.BuildImage(app, "latest", path.Join(basedir, "test/noCaptainYML"), false)
 	assert.Nil(t, res, "Docker build should not return any error")
 }
 
 func TestBuildImageError(t *testing.T) {
+	d := newTestDockerBackend(t)
 	app := App{Build: "Dockerfile.error", Image: "captain_test"}
-	res := buildImage(app, "latest", path.Join(basedir, "/test/noCaptainYML"), false)
+	res := d.BuildImage(app, "latest", path.Join(basedir, "/test/noCaptainYML"), false)
 	assert.NotNil(t, res, "Docker build should return an error")
 }
 
 func TestBuildImageCircleCI(t *testing.T) {
+	d := newTestDockerBackend(t)
 	os.Setenv("CIRCLECI", "true")
 	app := App{Build: "test/noCaptainYML/Dockerfile", Image: "captain_test"}
-	res := buildImage(app, "latest", path.Join(basedir, "/test/noCaptainYML"), false)
+	res := d.BuildImage(app, "latest", path.Join(basedir, "/test/noCaptainYML"), false)
 	assert.Nil(t, res, "Docker build should not return any error")
 }
 
 func TestTagImage(t *testing.T) {
+	d := newTestDockerBackend(t)
 	app := App{Image: "golang"}
-	res := tagImage(app, "1.4.2", "testing")
+	res := d.TagImage(app, "1.4.2", "testing")
 	assert.Nil(t, res, "Docker tag should not return any error")
 }
 
 func TestTagNonexistingImage(t *testing.T) {
+	d := newTestDockerBackend(t)
 	app := App{Image: "golang"}
-	res := tagImage(app, "nonexist", "testing")
+	res := d.TagImage(app, "nonexist", "testing")
 	assert.NotNil(t, res, "Docker tag should return an error")
 	println()
 }
 
 func TestImageExist(t *testing.T) {
+	d := newTestDockerBackend(t)
 	app := App{Image: "golang"}
-	exist := imageExist(app, "1.4.2")
+	exist := d.ImageExist(app, "1.4.2")
 	assert.Equal(t, true, exist, "Docker image golang:1.4.2 should exist")
 }
 
 func TestImageDoesNotExist(t *testing.T) {
+	d := newTestDockerBackend(t)
 	app := App{Image: "golang"}
-	exist := imageExist(app, "nonexist")
+	exist := d.ImageExist(app, "nonexist")
 	assert.Equal(t, false, exist, "Docker image golang:nonexist should not exist")
 }
+
+func TestDockerBuildArgs(t *testing.T) {
+	opts := docker.BuildImageOptions{
+		Name:       "harbur/test_stages:latest",
+		Dockerfile: "Dockerfile",
+		NoCache:    true,
+		BuildArgs:  []docker.BuildArg{{Name: "B", Value: "2"}, {Name: "A", Value: "1"}},
+		Labels:     map[string]string{"b": "2", "a": "1"},
+	}
+	args := dockerBuildArgs(opts, "runtime")
+	assert.Equal(t, []string{
+		"build",
+		"--tag", "harbur/test_stages:latest",
+		"--file", "Dockerfile",
+		"--target", "runtime",
+		"--no-cache",
+		"--build-arg", "A=1",
+		"--build-arg", "B=2",
+		"--label", "a=1",
+		"--label", "b=2",
+		"-",
+	}, args)
+}
@@ -0,0 +1,44 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// dockerfileStages returns the names of the build stages declared with
+// `FROM image AS name` in the Dockerfile, lower-cased.
+func dockerfileStages(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var stages []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		if strings.EqualFold(fields[len(fields)-2], "AS") {
+			stages = append(stages, strings.ToLower(fields[len(fields)-1]))
+		}
+	}
+	return stages, scanner.Err()
+}
+
+// hasStage reports whether the Dockerfile declares the build stage.
+func hasStage(filename string, stage string) (bool, error) {
+	stages, err := dockerfileStages(filename)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range stages {
+		if s == strings.ToLower(stage) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
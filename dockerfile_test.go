@@ -0,0 +1,30 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerfileStages(t *testing.T) {
+	stages, err := dockerfileStages(path.Join(basedir, "test/Stages/Dockerfile"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"base", "test", "runtime"}, stages)
+}
+
+func TestDockerfileStagesNone(t *testing.T) {
+	stages, err := dockerfileStages(path.Join(basedir, "test/Simple/Dockerfile"))
+	assert.NoError(t, err)
+	assert.Empty(t, stages)
+}
+
+func TestHasStage(t *testing.T) {
+	ok, err := hasStage(path.Join(basedir, "test/Stages/Dockerfile"), "Test")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = hasStage(path.Join(basedir, "test/Stages/Dockerfile"), "nonexistent")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -2,22 +2,49 @@ package captain // import "github.com/harbur/captain"
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
 )
 
 func execute(name string, arg ...string) error {
+	return executeWithOutput(os.Stdout, name, arg...)
+}
+
+// executeWithOutput runs the command sending both its stdout and stderr to out.
+// When out is the process stdout, stderr is kept separate.
+func executeWithOutput(out io.Writer, name string, arg ...string) error {
+	return executeWithInput(os.Stdin, out, name, arg...)
+}
+
+// executeWithInput runs the command like executeWithOutput, reading its stdin
+// from in.
+func executeWithInput(in io.Reader, out io.Writer, name string, arg ...string) error {
 	// Construct command for debug purposes
 	var command = name
 	for _, i := range arg {
 		command += " " + i
 	}
 
-	pDebug("Executing %s", command)
+	fDebug(out, "Executing %s", command)
 	cmd := exec.Command(name, arg...)
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = out
 	cmd.Stderr = os.Stderr
+	if out != os.Stdout {
+		cmd.Stderr = out
+	}
+	cmd.Stdin = in
+	return cmd.Run()
+}
+
+// executeWithStreams runs the command sending its stdout and stderr to the
+// given writers.
+func executeWithStreams(stdout, stderr io.Writer, name string, arg ...string) error {
+	fDebug(stdout, "Executing %s %s", name, strings.Join(arg, " "))
+	cmd := exec.Command(name, arg...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	cmd.Stdin = os.Stdin
 	return cmd.Run()
 }
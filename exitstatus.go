@@ -33,4 +33,8 @@ const (
 
 	// ExecuteFailed represents an execution failure
 	ExecuteFailed = 12
+
+	// IOFailed represents a failure to read or write a file, such as
+	// captain.yml or a test report
+	IOFailed = 74
 )
@@ -2,10 +2,12 @@ package captain // import "github.com/harbur/captain"
 
 import (
 	"fmt"
+	"net/url"
 	"os"
 
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
 )
 
 func getRepository() (*git.Repository, error) {
@@ -140,7 +142,7 @@ func getCurrentCommitFromRepository(repository *git.Repository) (string, error)
 func getCurrentTagsFromRepository(repository *git.Repository) ([]string, error) {
 	var currentTagsNames []string
 
-	tagRefs, err := repository.Branches()
+	tagRefs, err := repository.Tags()
 	if err != nil {
 		return currentTagsNames, err
 	}
@@ -151,10 +153,15 @@ func getCurrentTagsFromRepository(repository *git.Repository) ([]string, error)
 	}
 
 	err = tagRefs.ForEach(func(tagRef *plumbing.Reference) error {
-		if tagRef.Hash() == headRef.Hash() {
-			currentTagsNames = append(currentTagsNames, tagRef.Name().Short())
+		hash := tagRef.Hash()
 
-			return nil
+		// Annotated tags point to a tag object instead of the commit
+		if tag, err := repository.TagObject(hash); err == nil {
+			hash = tag.Target
+		}
+
+		if hash == headRef.Hash() {
+			currentTagsNames = append(currentTagsNames, tagRef.Name().Short())
 		}
 
 		return nil
@@ -165,3 +172,118 @@ func getCurrentTagsFromRepository(repository *git.Repository) ([]string, error)
 
 	return currentTagsNames, nil
 }
+
+// resolveCommit returns the full hash of the commit the revision (a branch,
+// a tag or an abbreviated hash) points to.
+func resolveCommit(revision string) (string, error) {
+	r, err := getRepository()
+	if err != nil {
+		return "", err
+	}
+
+	h, err := r.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
+
+// changedFiles returns the files changed since the revision, including the
+// uncommitted changes of the working tree. The paths are relative to the root
+// of the repository, which is returned as well.
+func changedFiles(revision string) ([]string, string, error) {
+	r, err := getRepository()
+	if err != nil {
+		return nil, "", err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return nil, "", err
+	}
+
+	from, err := r.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, "", err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return nil, "", err
+	}
+
+	fromTree, err := commitTree(r, *from)
+	if err != nil {
+		return nil, "", err
+	}
+	headTree, err := commitTree(r, head.Hash())
+	if err != nil {
+		return nil, "", err
+	}
+
+	changes, err := object.DiffTree(fromTree, headTree)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var files []string
+	for _, change := range changes {
+		if change.From.Name != "" {
+			files = append(files, change.From.Name)
+		}
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			files = append(files, change.To.Name)
+		}
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return nil, "", err
+	}
+	for file, s := range status {
+		if s.Staging != git.Unmodified || s.Worktree != git.Unmodified {
+			files = append(files, file)
+		}
+	}
+
+	return files, w.Filesystem.Root(), nil
+}
+
+func commitTree(repository *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := repository.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+// getTags returns the tags pointing to the current commit.
+func getTags() ([]string, error) {
+	r, err := getRepository()
+	if err != nil {
+		return nil, err
+	}
+	return getCurrentTagsFromRepository(r)
+}
+
+// getSource returns the URL of the origin remote, without credentials.
+func getSource() (string, error) {
+	r, err := getRepository()
+	if err != nil {
+		return "", err
+	}
+
+	remote, err := r.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return "", err
+	}
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return "", fmt.Errorf("no URL for remote %s", git.DefaultRemoteName)
+	}
+
+	if u, err := url.Parse(urls[0]); err == nil && u.User != nil {
+		u.User = nil
+		return u.String(), nil
+	}
+	return urls[0], nil
+}
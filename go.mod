@@ -8,9 +8,9 @@ require (
 	github.com/Nvveen/Gotty v0.0.0-20120604004816-cd527374f1e5 // indirect
 	github.com/containerd/continuity v0.0.0-20171004134916-1bed1ecb1dc4 // indirect
 	github.com/deckarep/golang-set v1.7.1
-	github.com/docker/docker v0.0.0-20171109040201-d4239a6e286f // indirect
+	github.com/docker/docker v0.0.0-20171109040201-d4239a6e286f
 	github.com/docker/go-connections v0.3.0 // indirect
-	github.com/docker/go-units v0.3.3 // indirect
+	github.com/docker/go-units v0.3.3
 	github.com/fatih/color v0.0.0-20170926111411-5df930a27be2
 	github.com/fsouza/go-dockerclient v0.0.0-20171104153632-ef22af91edfe
 	github.com/gogo/protobuf v0.0.0-20171108112821-3813b83578b9 // indirect
@@ -32,6 +32,7 @@ require (
 	gopkg.in/airbrake/gobrake.v2 v2.0.9 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
 	gopkg.in/src-d/go-git.v4 v4.10.0
-	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/yaml.v2 v2.2.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 	gotest.tools v2.2.0+incompatible // indirect
 )
@@ -0,0 +1,149 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// interpolatedKeys are the keys of an app whose values may reference
+// environment variables. The shell commands of pre, post and test are left
+// to the shell.
+var interpolatedKeys = []string{"image", "context", "build_arg", "labels", "annotations", "tags", "services", "smoke"}
+
+// interpolate replaces the ${VAR} and ${VAR:-default} references of s with
+// the values returned by lookup. A reference to an undefined variable without
+// default is an error. $$ is replaced with a literal $.
+func interpolate(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference %q", s[i:])
+			}
+			value, err := expand(s[i+2:i+end], lookup)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// expand returns the value of a VAR or VAR:-default reference.
+func expand(ref string, lookup func(string) (string, bool)) (string, error) {
+	name, def, hasDefault := ref, "", false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		name, def, hasDefault = ref[:i], ref[i+2:], true
+	}
+	if !validVariableName(name) {
+		return "", fmt.Errorf("invalid variable name %q", name)
+	}
+
+	value, ok := lookup(name)
+	if ok && value != "" {
+		return value, nil
+	}
+	if hasDefault {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("variable %s is not set", name)
+	}
+	return value, nil
+}
+
+func validVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// captainEnv returns a lookup of the environment variables, extended with
+// the variables provided by captain for the app: CAPTAIN_APP, CAPTAIN_REV
+// (the long commit SHA with longSha) and CAPTAIN_BRANCH (sanitized as a
+// tag). The variables provided by captain take precedence.
+func captainEnv(app string, longSha bool) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		switch name {
+		case "CAPTAIN_APP":
+			return app, true
+		case "CAPTAIN_REV":
+			if rev, err := getRevision(longSha); err == nil {
+				return rev, true
+			}
+		case "CAPTAIN_BRANCH":
+			if branches, err := getBranches(false); err == nil && len(branches) > 0 {
+				return sanitizeTag(branches[0]), true
+			}
+		}
+		return os.LookupEnv(name)
+	}
+}
+
+// interpolate replaces the variable references of the interpolated keys of
+// every app of the document.
+func (v *validator) interpolate(root *yaml.Node) {
+	if root.Kind == 0 || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return
+	}
+	doc := root.Content[0]
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		name, app := doc.Content[i].Value, doc.Content[i+1]
+		if app.Kind != yaml.MappingNode {
+			continue
+		}
+		lookup := captainEnv(name, v.longSha)
+		for j := 0; j+1 < len(app.Content); j += 2 {
+			key, value := app.Content[j].Value, app.Content[j+1]
+			for _, k := range interpolatedKeys {
+				if k == key {
+					v.interpolateNode(value, key, name, lookup)
+				}
+			}
+		}
+	}
+}
+
+// interpolateNode replaces the variable references of the scalars of the
+// node, recursing into sequences and mapping values.
+func (v *validator) interpolateNode(node *yaml.Node, key, app string, lookup func(string) (string, bool)) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value, err := interpolate(node.Value, lookup)
+		if err != nil {
+			v.errorf(node, "%s in %s of app %s", err, key, app)
+			return
+		}
+		node.Value = value
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			v.interpolateNode(item, key, app, lookup)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			v.interpolateNode(node.Content[i], key, app, lookup)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"REGISTRY": "quay.io", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	for in, out := range map[string]string{
+		"harbur/web":                         "harbur/web",
+		"${REGISTRY}/harbur/web":             "quay.io/harbur/web",
+		"${MISSING:-docker.io}/harbur/web":   "docker.io/harbur/web",
+		"${EMPTY:-default}":                  "default",
+		"${EMPTY}":                           "",
+		"echo $$HOME $${REGISTRY} $HOME $":   "echo $HOME ${REGISTRY} $HOME $",
+		"${REGISTRY:-}-${MISSING:-a:-b}-end": "quay.io-a:-b-end",
+	} {
+		res, err := interpolate(in, lookup)
+		assert.NoError(t, err, in)
+		assert.Equal(t, out, res, in)
+	}
+
+	for in, msg := range map[string]string{
+		"${MISSING}/harbur/web": "variable MISSING is not set",
+		"${REGISTRY":            `unterminated variable reference "${REGISTRY"`,
+		"${}":                   `invalid variable name ""`,
+		"${1A}":                 `invalid variable name "1A"`,
+	} {
+		_, err := interpolate(in, lookup)
+		assert.EqualError(t, err, msg, in)
+	}
+}
+
+func TestInterpolateConfig(t *testing.T) {
+	os.Setenv("CAPTAIN_TEST_REGISTRY", "localhost:5000")
+	defer os.Unsetenv("CAPTAIN_TEST_REGISTRY")
+
+	c, err := unmarshal("captain.yml", []byte(`
+web:
+  image: ${CAPTAIN_TEST_REGISTRY}/harbur/${CAPTAIN_APP}
+  context: ${CAPTAIN_TEST_CONTEXT:-.}
+  build_arg:
+    registry: ${CAPTAIN_TEST_REGISTRY}
+  wants: []
+`), false)
+	assert.NoError(t, err)
+	app := c.Apps["web"]
+	assert.Equal(t, "localhost:5000/harbur/web", app.Image)
+	assert.Equal(t, ".", app.Context)
+	assert.Equal(t, map[string]string{"registry": "localhost:5000"}, app.Build_arg)
+}
+
+func TestInterpolateShellVariables(t *testing.T) {
+	// Shell commands are left to the shell
+	c, err := unmarshal("captain.yml", []byte(`
+web:
+  image: harbur/web
+  pre:
+    - for f in a b; do echo $f ${f}; done
+  post:
+    - echo ${CAPTAIN_TEST_UNDEFINED}
+  test:
+    - set -- one; echo $${1}
+`), false)
+	assert.NoError(t, err)
+	app := c.Apps["web"]
+	assert.Equal(t, []string{"for f in a b; do echo $f ${f}; done"}, app.Pre)
+	assert.Equal(t, []string{"echo ${CAPTAIN_TEST_UNDEFINED}"}, app.Post)
+	assert.Equal(t, []TestCommand{{Shell: "set -- one; echo $${1}"}}, app.Test)
+}
+
+func TestInterpolateUndefined(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: ${CAPTAIN_TEST_UNDEFINED}/harbur/test_web
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 4, errs[0].Line)
+	assert.Equal(t, 10, errs[0].Column)
+	assert.Equal(t, "variable CAPTAIN_TEST_UNDEFINED is not set in image of app web", errs[0].Message)
+}
+
+func TestCaptainEnv(t *testing.T) {
+	lookup := captainEnv("web", false)
+	app, ok := lookup("CAPTAIN_APP")
+	assert.True(t, ok)
+	assert.Equal(t, "web", app)
+
+	if rev, err := getRevision(false); err == nil {
+		value, ok := lookup("CAPTAIN_REV")
+		assert.True(t, ok)
+		assert.Equal(t, rev, value)
+	}
+	if rev, err := getRevision(true); err == nil {
+		value, ok := captainEnv("web", true)("CAPTAIN_REV")
+		assert.True(t, ok)
+		assert.Equal(t, rev, value)
+		assert.Len(t, value, 40)
+	}
+
+	// Captain provided variables take precedence over the environment
+	os.Setenv("CAPTAIN_APP", "backend")
+	defer os.Unsetenv("CAPTAIN_APP")
+	app, _ = lookup("CAPTAIN_APP")
+	assert.Equal(t, "web", app)
+
+	if branches, err := getBranches(false); err == nil {
+		os.Setenv("CAPTAIN_BRANCH", "other")
+		defer os.Unsetenv("CAPTAIN_BRANCH")
+		branch, ok := lookup("CAPTAIN_BRANCH")
+		assert.True(t, ok)
+		assert.Equal(t, sanitizeTag(branches[0]), branch)
+	}
+
+	os.Setenv("CAPTAIN_TEST_VALUE", "value")
+	defer os.Unsetenv("CAPTAIN_TEST_VALUE")
+	value, ok := lookup("CAPTAIN_TEST_VALUE")
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+}
@@ -0,0 +1,82 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"time"
+)
+
+// The standard labels of the OCI image spec set from the git metadata
+const (
+	labelRevision = "org.opencontainers.image.revision"
+	labelSource   = "org.opencontainers.image.source"
+	labelCreated  = "org.opencontainers.image.created"
+	labelVersion  = "org.opencontainers.image.version"
+)
+
+// gitMetadata describes the commit an image is built from.
+type gitMetadata struct {
+	Commit  string
+	Branch  string
+	Tag     string
+	Source  string
+	Created string
+}
+
+// readGitMetadata reads the metadata of the current commit. Values that
+// cannot be determined, e.g. without a git repository, are left empty.
+func readGitMetadata(now time.Time) gitMetadata {
+	m := gitMetadata{Created: now.UTC().Format(time.RFC3339)}
+	if !isGit() {
+		return m
+	}
+
+	m.Commit, _ = getRevision(true)
+	if r, err := getRepository(); err == nil {
+		if branches, err := getCurrentBranchesFromRepository(r); err == nil && len(branches) > 0 {
+			m.Branch = branches[0]
+		}
+	}
+	if tags, err := getTags(); err == nil && len(tags) > 0 {
+		m.Tag = tags[0]
+	}
+	m.Source, _ = getSource()
+	return m
+}
+
+// apply returns a copy of the app passing the metadata as the GIT_COMMIT,
+// GIT_BRANCH, GIT_TAG and BUILD_DATE build args and labeling its image with
+// the OCI annotations. Build args and labels defined by the app are kept.
+func (m gitMetadata) apply(app App) App {
+	args := map[string]string{
+		"GIT_COMMIT": m.Commit,
+		"GIT_BRANCH": m.Branch,
+		"GIT_TAG":    m.Tag,
+		"BUILD_DATE": m.Created,
+	}
+	buildArgs := make(map[string]string)
+	for k, v := range args {
+		if v != "" {
+			buildArgs[k] = v
+		}
+	}
+	for k, v := range app.Build_arg {
+		buildArgs[k] = v
+	}
+	app.Build_arg = buildArgs
+
+	version := m.Tag
+	if version == "" && len(m.Commit) >= 7 {
+		version = m.Commit[:7]
+	}
+	labels := map[string]string{
+		labelRevision: m.Commit,
+		labelSource:   m.Source,
+		labelCreated:  m.Created,
+		labelVersion:  version,
+	}
+	for k, v := range labels {
+		if _, ok := app.labels[k]; !ok && v != "" {
+			app = app.withLabel(k, v)
+		}
+	}
+	return app
+}
@@ -1,7 +1,8 @@
 package depgraph
 
 import (
-	"errors"
+	"fmt"
+	"strings"
 
 	mapset "github.com/deckarep/golang-set"
 )
@@ -27,8 +28,51 @@ func NewNode(name string, deps ...string) *Node {
 
 type Graph []*Node
 
+// CycleError is returned when nodes depend on each other. Path starts and
+// ends with the same node, e.g. a -> b -> c -> a.
+type CycleError struct {
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("circular dependency: %s", strings.Join(e.Path, " -> "))
+}
+
+// MissingDependencyError is returned when a node depends on a node which is
+// not part of the graph.
+type MissingDependencyError struct {
+	Name       string
+	Dependency string
+}
+
+func (e *MissingDependencyError) Error() string {
+	return fmt.Sprintf("%s depends on unknown %s", e.Name, e.Dependency)
+}
+
 // Resolves the dependency graph
+//
+// On error the returned graph holds the nodes which could be resolved, that
+// is the nodes not depending on the cycle or the missing dependency.
 func ResolveGraph(graph Graph) (Graph, error) {
+	layers, err := ResolveLayers(graph)
+
+	var resolved Graph
+	for _, layer := range layers {
+		resolved = append(resolved, layer...)
+	}
+
+	return resolved, err
+}
+
+// ResolveLayers resolves the dependency graph into layers. Every node of a
+// layer only depends on nodes of the previous layers, so the nodes of a
+// single layer can be processed concurrently. The nodes of a layer keep the
+// order they have in the graph.
+//
+// When the resolution gets stuck, the layers resolved so far are returned
+// with a *MissingDependencyError for the first node depending on an unknown
+// node, or otherwise with a *CycleError.
+func ResolveLayers(graph Graph) ([]Graph, error) {
 	// A map containing the node names and the actual node object
 	nodeNames := make(map[string]*Node)
 
@@ -49,31 +93,31 @@ func ResolveGraph(graph Graph) (Graph, error) {
 	// Iteratively find and remove nodes from the graph which have no dependencies.
 	// If at some point there are still nodes in the graph and we cannot find
 	// nodes without dependencies, that means we have a circular dependency
-	var resolved Graph
+	var layers []Graph
 	for len(nodeDependencies) != 0 {
-		// Get all nodes from the graph which have no dependencies
+		// Get all nodes from the graph which have no dependencies, in the
+		// order of the graph
 		readySet := mapset.NewSet()
-		for name, deps := range nodeDependencies {
-			if deps.Cardinality() == 0 {
-				readySet.Add(name)
+		var layer Graph
+		for _, node := range graph {
+			deps, ok := nodeDependencies[node.Name]
+			if ok && deps.Cardinality() == 0 && !readySet.Contains(node.Name) {
+				readySet.Add(node.Name)
+				layer = append(layer, node)
 			}
 		}
 
-		// If there aren't any ready nodes, then we have a cicular dependency
+		// If there aren't any ready nodes, then we have a missing or
+		// circular dependency
 		if readySet.Cardinality() == 0 {
-			var g Graph
-			for name := range nodeDependencies {
-				g = append(g, nodeNames[name])
-			}
-
-			return g, errors.New("Circular dependency found")
+			return layers, unresolvable(graph, nodeNames, nodeDependencies)
 		}
 
-		// Remove the ready nodes and add them to the resolved graph
-		for name := range readySet.Iter() {
-			delete(nodeDependencies, name.(string))
-			resolved = append(resolved, nodeNames[name.(string)])
+		// Remove the ready nodes and add them to a new layer
+		for _, node := range layer {
+			delete(nodeDependencies, node.Name)
 		}
+		layers = append(layers, layer)
 
 		// Also make sure to remove the ready nodes from the
 		// remaining node dependencies as well
@@ -83,5 +127,45 @@ func ResolveGraph(graph Graph) (Graph, error) {
 		}
 	}
 
-	return resolved, nil
+	return layers, nil
+}
+
+// unresolvable explains why the remaining nodes cannot be resolved. The
+// nodes are visited in graph order so the same error is always reported.
+func unresolvable(graph Graph, nodeNames map[string]*Node, remaining map[string]mapset.Set) error {
+	for _, node := range graph {
+		if _, ok := remaining[node.Name]; !ok {
+			continue
+		}
+		for _, dep := range node.deps {
+			if _, ok := nodeNames[dep]; !ok {
+				return &MissingDependencyError{Name: node.Name, Dependency: dep}
+			}
+		}
+	}
+
+	// Every remaining node depends on another remaining node, so following
+	// the dependencies from any of them eventually visits a node twice.
+	for _, node := range graph {
+		if _, ok := remaining[node.Name]; !ok {
+			continue
+		}
+		var path []string
+		visited := make(map[string]int)
+		name := node.Name
+		for {
+			if i, ok := visited[name]; ok {
+				return &CycleError{Path: append(path[i:], name)}
+			}
+			visited[name] = len(path)
+			path = append(path, name)
+			for _, dep := range nodeNames[name].deps {
+				if _, ok := remaining[dep]; ok {
+					name = dep
+					break
+				}
+			}
+		}
+	}
+	return nil
 }
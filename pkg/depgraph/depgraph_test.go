@@ -0,0 +1,113 @@
+package depgraph
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func names(g Graph) []string {
+	var n []string
+	for _, node := range g {
+		n = append(n, node.Name)
+	}
+	sort.Strings(n)
+	return n
+}
+
+func TestResolveLayers(t *testing.T) {
+	g := Graph{
+		NewNode("web", "base"),
+		NewNode("backend", "base"),
+		NewNode("base"),
+		NewNode("e2e", "web", "backend"),
+	}
+
+	layers, err := ResolveLayers(g)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(layers))
+	assert.Equal(t, []string{"base"}, names(layers[0]))
+	assert.Equal(t, []string{"backend", "web"}, names(layers[1]))
+	assert.Equal(t, []string{"e2e"}, names(layers[2]))
+}
+
+func TestResolveLayersCircular(t *testing.T) {
+	g := Graph{
+		NewNode("a", "b"),
+		NewNode("b", "a"),
+	}
+
+	_, err := ResolveLayers(g)
+	assert.Error(t, err)
+}
+
+func TestResolveLayersCyclePath(t *testing.T) {
+	g := Graph{
+		NewNode("base"),
+		NewNode("web", "base", "a"),
+		NewNode("a", "b"),
+		NewNode("b", "c"),
+		NewNode("c", "a"),
+		NewNode("backend", "base"),
+	}
+
+	layers, err := ResolveLayers(g)
+	assert.Equal(t, &CycleError{Path: []string{"a", "b", "c", "a"}}, err)
+	assert.Equal(t, "circular dependency: a -> b -> c -> a", err.Error())
+	assert.Equal(t, 2, len(layers))
+	assert.Equal(t, []string{"base"}, names(layers[0]))
+	assert.Equal(t, []string{"backend"}, names(layers[1]))
+}
+
+func TestResolveLayersSelfDependency(t *testing.T) {
+	_, err := ResolveLayers(Graph{NewNode("a", "a")})
+	assert.Equal(t, "circular dependency: a -> a", err.Error())
+}
+
+func TestResolveLayersMissingDependency(t *testing.T) {
+	g := Graph{
+		NewNode("base"),
+		NewNode("web", "base", "nonexistent"),
+		NewNode("e2e", "web"),
+	}
+
+	resolved, err := ResolveGraph(g)
+	assert.Equal(t, &MissingDependencyError{Name: "web", Dependency: "nonexistent"}, err)
+	assert.Equal(t, "web depends on unknown nonexistent", err.Error())
+	assert.Equal(t, []string{"base"}, names(resolved))
+}
+
+func TestResolveGraph(t *testing.T) {
+	g := Graph{
+		NewNode("web", "base"),
+		NewNode("base"),
+	}
+
+	resolved, err := ResolveGraph(g)
+	assert.NoError(t, err)
+	assert.Equal(t, "base", resolved[0].Name)
+	assert.Equal(t, "web", resolved[1].Name)
+}
+
+func TestResolveLayersOrder(t *testing.T) {
+	g := Graph{
+		NewNode("zeta"),
+		NewNode("web", "base"),
+		NewNode("alpha"),
+		NewNode("base"),
+		NewNode("backend", "base"),
+		NewNode("beta"),
+	}
+
+	for i := 0; i < 10; i++ {
+		resolved, err := ResolveGraph(g)
+		assert.NoError(t, err)
+
+		var order []string
+		for _, node := range resolved {
+			order = append(order, node.Name)
+		}
+		assert.Equal(t, []string{"zeta", "alpha", "base", "beta", "web", "backend"}, order)
+	}
+}
@@ -0,0 +1,468 @@
+// Package registry implements a client of the Docker Registry HTTP API V2,
+// able to inspect, copy and retag images without a Docker daemon.
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Media types of the manifests accepted by the client
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+var acceptedMediaTypes = []string{
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}
+
+// ErrNotFound is returned when a manifest or a blob does not exist
+var ErrNotFound = errors.New("not found")
+
+// Manifest is a raw image manifest, manifest list or index
+type Manifest struct {
+	MediaType string
+	Digest    string
+	Body      []byte
+}
+
+// descriptor references a blob or a manifest from a manifest
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+// manifestContent holds the references of image manifests and indexes
+type manifestContent struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// Client of a registry
+type Client struct {
+	// Host of the registry, with its port
+	Host string
+
+	// Username and Password authenticate against the registry when set
+	Username string
+	Password string
+
+	// Insecure uses plain HTTP. It is implied for localhost registries.
+	Insecure bool
+
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// New returns a client of the registry host.
+func New(host string, username string, password string) *Client {
+	return &Client{Host: host, Username: username, Password: password}
+}
+
+func (c *Client) baseURL() string {
+	scheme := "https"
+	hostname := strings.Split(c.Host, ":")[0]
+	if c.Insecure || hostname == "localhost" || hostname == "127.0.0.1" {
+		scheme = "http"
+	}
+	return scheme + "://" + c.Host + "/v2/"
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Inspect returns the manifest of the reference, a tag or a digest, of the
+// repository.
+func (c *Client) Inspect(repo string, ref string) (*Manifest, error) {
+	req, err := http.NewRequest("GET", c.baseURL()+repo+"/manifests/"+ref, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(acceptedMediaTypes, ", "))
+
+	resp, err := c.do(req, pullScope(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusOK); err == ErrNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("manifest %s:%s: %s", repo, ref, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		Body:      body,
+	}
+	if m.Digest == "" {
+		m.Digest = digest(body)
+	}
+	return m, nil
+}
+
+// PutManifest uploads the manifest under the reference of the repository.
+func (c *Client) PutManifest(repo string, ref string, m *Manifest) error {
+	req, err := http.NewRequest("PUT", c.baseURL()+repo+"/manifests/"+ref, bytes.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", m.MediaType)
+
+	resp, err := c.do(req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return fmt.Errorf("put manifest %s:%s: %s", repo, ref, err)
+	}
+	return nil
+}
+
+// Tag points the tag of the repository to the manifest of the source
+// reference, without transferring any layer.
+func (c *Client) Tag(repo string, src string, tag string) error {
+	m, err := c.Inspect(repo, src)
+	if err != nil {
+		return err
+	}
+	return c.PutManifest(repo, tag, m)
+}
+
+// Copy copies the image of the source repository to the tag of the
+// destination repository. Blobs are mounted across repositories when the
+// registry supports it, or transferred through the client otherwise.
+func (c *Client) Copy(srcRepo string, src string, dstRepo string, tag string) error {
+	if srcRepo == dstRepo {
+		return c.Tag(srcRepo, src, tag)
+	}
+
+	m, err := c.Inspect(srcRepo, src)
+	if err != nil {
+		return err
+	}
+	if err := c.copyReferences(srcRepo, dstRepo, m); err != nil {
+		return err
+	}
+	return c.PutManifest(dstRepo, tag, m)
+}
+
+// copyReferences copies the blobs and child manifests of the manifest.
+func (c *Client) copyReferences(srcRepo string, dstRepo string, m *Manifest) error {
+	var content manifestContent
+	if err := json.Unmarshal(m.Body, &content); err != nil {
+		return fmt.Errorf("invalid manifest %s: %s", m.Digest, err)
+	}
+
+	for _, child := range content.Manifests {
+		cm, err := c.Inspect(srcRepo, child.Digest)
+		if err != nil {
+			return err
+		}
+		if err := c.copyReferences(srcRepo, dstRepo, cm); err != nil {
+			return err
+		}
+		if err := c.PutManifest(dstRepo, child.Digest, cm); err != nil {
+			return err
+		}
+	}
+
+	blobs := content.Layers
+	if content.Config != nil {
+		blobs = append(blobs, *content.Config)
+	}
+	for _, blob := range blobs {
+		if err := c.copyBlob(srcRepo, dstRepo, blob.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlob copies the blob between repositories of the registry.
+func (c *Client) copyBlob(srcRepo string, dstRepo string, dgst string) error {
+	q := url.Values{"mount": {dgst}, "from": {srcRepo}}
+	req, err := http.NewRequest("POST", c.baseURL()+dstRepo+"/blobs/uploads/?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, pushScope(dstRepo), pullScope(srcRepo))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		// Mounted
+		return nil
+	case http.StatusAccepted:
+		// Mount not supported, an upload session was started instead
+		return c.transferBlob(srcRepo, dstRepo, dgst, resp.Header.Get("Location"))
+	}
+	return fmt.Errorf("mount blob %s: %s", dgst, checkResponse(resp, http.StatusCreated))
+}
+
+// transferBlob downloads the blob from the source repository and uploads it
+// to the upload session location of the destination repository.
+func (c *Client) transferBlob(srcRepo string, dstRepo string, dgst string, location string) error {
+	req, err := http.NewRequest("GET", c.baseURL()+srcRepo+"/blobs/"+dgst, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, pullScope(srcRepo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return fmt.Errorf("get blob %s: %s", dgst, err)
+	}
+
+	u, err := url.Parse(c.baseURL())
+	if err != nil {
+		return err
+	}
+	upload, err := u.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := upload.Query()
+	q.Set("digest", dgst)
+	upload.RawQuery = q.Encode()
+
+	// Stream the blob from the source to the destination
+	req, err = http.NewRequest("PUT", upload.String(), resp.Body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = resp.ContentLength
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// The token of the upload session is reused, the body cannot be sent
+	// again after an authentication challenge
+	put, err := c.do(req, pushScope(dstRepo), pullScope(srcRepo))
+	if err != nil {
+		return err
+	}
+	defer put.Body.Close()
+	if err := checkResponse(put, http.StatusCreated); err != nil {
+		return fmt.Errorf("upload blob %s: %s", dgst, err)
+	}
+	return nil
+}
+
+func pullScope(repo string) string {
+	return "repository:" + repo + ":pull"
+}
+
+func pushScope(repo string) string {
+	return "repository:" + repo + ":pull,push"
+}
+
+// do sends the request, authenticating it against the registry for the
+// scopes when challenged.
+func (c *Client) do(req *http.Request, scopes ...string) (*http.Response, error) {
+	key := strings.Join(scopes, " ")
+	c.authorize(req, key)
+	resp, err := c.httpClient().Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// Streamed bodies, such as blobs, cannot be sent again
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	if err := c.authenticate(resp.Header.Get("WWW-Authenticate"), key, scopes); err != nil {
+		return nil, err
+	}
+
+	retry, err := http.NewRequest(req.Method, req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		retry.ContentLength = req.ContentLength
+	}
+	retry.Header = req.Header
+	c.authorize(retry, key)
+	return c.httpClient().Do(retry)
+}
+
+func (c *Client) authorize(req *http.Request, key string) {
+	c.mu.Lock()
+	token, ok := c.tokens[key]
+	c.mu.Unlock()
+
+	switch {
+	case ok && token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case ok || c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// authenticate answers the challenge of the registry. Basic challenges use
+// the credentials of the client, bearer challenges fetch a token for the
+// scopes from the authorization service.
+func (c *Client) authenticate(challenge string, key string, scopes []string) error {
+	scheme, params := parseChallenge(challenge)
+
+	var token string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return errors.New("registry requires authentication")
+		}
+	case "bearer":
+		var err error
+		if token, err = c.fetchToken(params, scopes); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+	}
+	c.tokens[key] = token
+	return nil
+}
+
+func (c *Client) fetchToken(params map[string]string, scopes []string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication realm %q", params["realm"])
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if len(scopes) == 0 && params["scope"] != "" {
+		scopes = []string{params["scope"]}
+	}
+	for _, scope := range scopes {
+		q.Add("scope", scope)
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return "", fmt.Errorf("fetch token: %s", err)
+	}
+
+	var answer struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", fmt.Errorf("fetch token: %s", err)
+	}
+	if answer.Token != "" {
+		return answer.Token, nil
+	}
+	return answer.AccessToken, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for len(rest) > 0 {
+		eq := strings.IndexRune(rest, '=')
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexRune(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.IndexRune(rest, ','); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[strings.ToLower(name)] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+func checkResponse(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func digest(body []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+}
@@ -0,0 +1,129 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/harbur/captain/pkg/registry/registrytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspect(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	dgst := s.AddImage("harbur/web", "latest", "layer")
+
+	m, err := New(s.Host(), "", "").Inspect("harbur/web", "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, m.Digest)
+	assert.Equal(t, MediaTypeDockerManifest, m.MediaType)
+}
+
+func TestInspectNotFound(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+
+	_, err := New(s.Host(), "", "").Inspect("harbur/web", "latest")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestTag(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	dgst := s.AddImage("harbur/web", "abcdef0", "layer")
+
+	err := New(s.Host(), "", "").Tag("harbur/web", "abcdef0", "stable")
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/web", "stable"))
+}
+
+func TestCopyMount(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	dgst := s.AddImage("harbur/web", "latest", "layer")
+
+	err := New(s.Host(), "", "").Copy("harbur/web", "latest", "harbur/mirror", "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/mirror", "latest"))
+	assert.True(t, s.HasBlob("harbur/mirror", registrytest.Digest([]byte("layer"))))
+}
+
+func TestCopyWithoutMount(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.NoMount = true
+	s.AddImage("harbur/web", "latest", "layer")
+
+	err := New(s.Host(), "", "").Copy("harbur/web", "latest", "harbur/mirror", "v1")
+	assert.NoError(t, err)
+	assert.True(t, s.HasBlob("harbur/mirror", registrytest.Digest([]byte("layer"))))
+	assert.NotEmpty(t, s.ManifestDigest("harbur/mirror", "v1"))
+}
+
+func TestCopyWithoutMountBearerAuth(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.NoMount = true
+	s.Username, s.Password, s.Token = "user", "secret", "token"
+	s.AddImage("harbur/web", "latest", "layer")
+
+	// The streamed blob is uploaded with the token of the upload session
+	err := New(s.Host(), "user", "secret").Copy("harbur/web", "latest", "harbur/mirror", "v1")
+	assert.NoError(t, err)
+	assert.True(t, s.HasBlob("harbur/mirror", registrytest.Digest([]byte("layer"))))
+}
+
+func TestCopyIndex(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	amd64 := s.AddImage("harbur/web", "", "amd64 layer")
+	arm64 := s.AddImage("harbur/web", "", "arm64 layer")
+	index := `{"schemaVersion":2,"manifests":[{"digest":"` + amd64 + `"},{"digest":"` + arm64 + `"}]}`
+	dgst := s.AddManifest("harbur/web", "latest", MediaTypeOCIIndex, []byte(index))
+
+	err := New(s.Host(), "", "").Copy("harbur/web", "latest", "harbur/mirror", "latest")
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/mirror", "latest"))
+	assert.Equal(t, amd64, s.ManifestDigest("harbur/mirror", amd64))
+	assert.True(t, s.HasBlob("harbur/mirror", registrytest.Digest([]byte("arm64 layer"))))
+}
+
+func TestBasicAuth(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.Username, s.Password = "user", "secret"
+	s.AddImage("harbur/web", "latest", "layer")
+
+	_, err := New(s.Host(), "", "").Inspect("harbur/web", "latest")
+	assert.Error(t, err, "Anonymous access should be refused")
+
+	_, err = New(s.Host(), "user", "secret").Inspect("harbur/web", "latest")
+	assert.NoError(t, err)
+}
+
+func TestBearerAuth(t *testing.T) {
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.Username, s.Password, s.Token = "user", "secret", "token"
+	s.AddImage("harbur/web", "latest", "layer")
+
+	c := New(s.Host(), "user", "secret")
+	assert.NoError(t, c.Tag("harbur/web", "latest", "stable"))
+	assert.NotEmpty(t, s.ManifestDigest("harbur/web", "stable"))
+
+	_, err := New(s.Host(), "user", "wrong").Inspect("harbur/web", "latest")
+	assert.Error(t, err)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:harbur/web:pull"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:harbur/web:pull",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm="registry"`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, "registry", params["realm"])
+}
@@ -0,0 +1,276 @@
+// Package registrytest provides an in-memory registry implementing the parts
+// of the Docker Registry HTTP API V2 used by captain, for tests.
+package registrytest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Server is an in-memory registry
+type Server struct {
+	*httptest.Server
+
+	// Username and Password, when set, are required through basic
+	// authentication, or through a bearer token when Token is set too.
+	Username string
+	Password string
+	Token    string
+
+	// NoMount makes the registry refuse cross-repository blob mounts
+	NoMount bool
+
+	mu        sync.Mutex
+	manifests map[string]manifest
+	blobs     map[string][]byte
+	uploads   int
+}
+
+type manifest struct {
+	mediaType string
+	body      []byte
+}
+
+// NewServer starts a new in-memory registry. It must be closed after use.
+func NewServer() *Server {
+	s := &Server{
+		manifests: make(map[string]manifest),
+		blobs:     make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the host of the registry, to use in image references.
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Digest returns the digest of the content.
+func Digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+// AddBlob stores the blob in the repository and returns its digest.
+func (s *Server) AddBlob(repo string, content []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dgst := Digest(content)
+	s.blobs[repo+"@"+dgst] = content
+	return dgst
+}
+
+// AddImage stores a single layer image under the tag of the repository and
+// returns the digest of its manifest.
+func (s *Server) AddImage(repo string, tag string, layer string) string {
+	config := s.AddBlob(repo, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layerDigest := s.AddBlob(repo, []byte(layer))
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config":        map[string]string{"mediaType": "application/vnd.docker.container.image.v1+json", "digest": config},
+		"layers":        []map[string]string{{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "digest": layerDigest}},
+	})
+	return s.AddManifest(repo, tag, "application/vnd.docker.distribution.manifest.v2+json", body)
+}
+
+// AddManifest stores the manifest under the tag of the repository and
+// returns its digest.
+func (s *Server) AddManifest(repo string, tag string, mediaType string, body []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dgst := Digest(body)
+	m := manifest{mediaType: mediaType, body: body}
+	s.manifests[repo+"@"+dgst] = m
+	if tag != "" {
+		s.manifests[repo+":"+tag] = m
+	}
+	return dgst
+}
+
+// ManifestDigest returns the digest of the manifest of the reference, or an
+// empty string when it does not exist.
+func (s *Server) ManifestDigest(repo string, ref string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.manifests[manifestKey(repo, ref)]
+	if !ok {
+		return ""
+	}
+	return Digest(m.body)
+}
+
+// HasBlob reports whether the blob exists in the repository.
+func (s *Server) HasBlob(repo string, dgst string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.blobs[repo+"@"+dgst]
+	return ok
+}
+
+func manifestKey(repo string, ref string) string {
+	if strings.HasPrefix(ref, "sha256:") {
+		return repo + "@" + ref
+	}
+	return repo + ":" + ref
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		s.serveToken(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		if s.Token != "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"`, s.URL))
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		s.serveManifest(w, r, parts[0], parts[1])
+	case strings.HasSuffix(path, "/blobs/uploads/"):
+		s.serveUploadStart(w, r, strings.TrimSuffix(path, "/blobs/uploads/"))
+	case strings.Contains(path, "/blobs/uploads/"):
+		parts := strings.SplitN(path, "/blobs/uploads/", 2)
+		s.serveUploadEnd(w, r, parts[0])
+	case strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		s.serveBlob(w, r, parts[0], parts[1])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Username == "" {
+		return true
+	}
+	if s.Token != "" {
+		return r.Header.Get("Authorization") == "Bearer "+s.Token
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && username == s.Username && password == s.Password
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || username != s.Username || password != s.Password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"token": s.Token})
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, repo string, ref string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		s.mu.Lock()
+		m, ok := s.manifests[manifestKey(repo, ref)]
+		s.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", Digest(m.body))
+		if r.Method == "GET" {
+			w.Write(m.body)
+		}
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tag := ref
+		if strings.HasPrefix(ref, "sha256:") {
+			tag = ""
+		}
+		dgst := s.AddManifest(repo, tag, r.Header.Get("Content-Type"), body)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, repo string, dgst string) {
+	s.mu.Lock()
+	blob, ok := s.blobs[repo+"@"+dgst]
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", dgst)
+	if r.Method == "GET" {
+		w.Write(blob)
+	}
+}
+
+func (s *Server) serveUploadStart(w http.ResponseWriter, r *http.Request, repo string) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	mount, from := r.URL.Query().Get("mount"), r.URL.Query().Get("from")
+	if mount != "" && !s.NoMount {
+		s.mu.Lock()
+		blob, ok := s.blobs[from+"@"+mount]
+		if ok {
+			s.blobs[repo+"@"+mount] = blob
+		}
+		s.mu.Unlock()
+		if ok {
+			w.Header().Set("Docker-Content-Digest", mount)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.uploads++
+	id := s.uploads
+	s.mu.Unlock()
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repo, id))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) serveUploadEnd(w http.ResponseWriter, r *http.Request, repo string) {
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	dgst := r.URL.Query().Get("digest")
+	if Digest(body) != dgst {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.AddBlob(repo, body)
+	w.Header().Set("Docker-Content-Digest", dgst)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,223 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// TagPolicy defines the tags captain manages for the image of an app, which
+// are computed from the state of the git repository.
+type TagPolicy struct {
+	// Latest tags the last build of the app as latest
+	Latest bool
+
+	// Sanitize replaces the characters of the branch names which are not
+	// allowed in tags, such as the / of feature/login, with -
+	Sanitize bool
+
+	// Semver expands the git tags following semantic versioning, so that
+	// v1.2.3 is also tagged as 1, 1.2 and 1.2.3
+	Semver bool
+}
+
+// DefaultTagPolicy is the policy used when BuildOptions has none
+var DefaultTagPolicy = TagPolicy{Latest: true, Sanitize: true}
+
+// policy returns the tag policy of the options
+func (opts BuildOptions) policy() TagPolicy {
+	if opts.Tag_policy != nil {
+		return *opts.Tag_policy
+	}
+	return DefaultTagPolicy
+}
+
+// tagKind tells which rule of the policy a tag comes from
+type tagKind int
+
+const (
+	tagLatest tagKind = iota
+	tagCommit
+	tagBranch
+	tagBranchCommit
+	tagVersion
+	tagCustom
+)
+
+type managedTag struct {
+	name string
+	kind tagKind
+}
+
+// gitState holds the state of the git repository the tags are computed from
+type gitState struct {
+	git      bool
+	dirty    bool
+	rev      string
+	sha      string
+	branches []string
+	tags     []string
+}
+
+// readGitState reads the state of the git repository of the working
+// directory. Without repository, the returned state is empty.
+func readGitState(allBranches, longSha bool) (gitState, error) {
+	if !isGit() {
+		return gitState{}, nil
+	}
+
+	r, err := getRepository()
+	if err != nil {
+		return gitState{}, err
+	}
+	state := gitState{git: true, dirty: isDirty()}
+
+	if state.sha, err = getCurrentCommitFromRepository(r); err != nil {
+		return state, err
+	}
+	state.rev = state.sha[:7]
+	if longSha {
+		state.rev = state.sha
+	}
+
+	if state.branches, err = getCurrentBranchesFromRepository(r); err != nil {
+		return state, err
+	}
+	if !allBranches && len(state.branches) > 1 {
+		state.branches = state.branches[:1]
+	}
+
+	state.tags, err = getCurrentTagsFromRepository(r)
+	return state, err
+}
+
+// branchTags returns the names of the branches and git tags of the state
+// usable as image tags.
+func (p TagPolicy) branchTags(state gitState) []string {
+	var tags []string
+	for _, branch := range append(state.branches, state.tags...) {
+		if p.Sanitize {
+			branch = sanitizeTag(branch)
+		}
+		tags = append(tags, branch)
+	}
+	return tags
+}
+
+// buildTag returns the tag the image of the app is built as, the other tags
+// are then added to it. Without latest, local changes are built as
+// <rev>-dirty, and builds outside git need the user-defined tag custom.
+func (p TagPolicy) buildTag(state gitState, custom string) (string, error) {
+	switch {
+	case p.Latest:
+		return "latest", nil
+	case state.git && state.dirty:
+		return state.rev + "-dirty", nil
+	case state.git:
+		return state.rev, nil
+	case custom != "":
+		return custom, nil
+	}
+	return "", errors.New("no tag to build the image as, outside a git repository a tag is required without latest")
+}
+
+// tags returns the tags of the app for the git state, in order and without
+// duplicates. Custom is the user-defined tag, if any.
+func (p TagPolicy) tags(state gitState, app App, custom string) ([]managedTag, error) {
+	var tags []managedTag
+	seen := make(map[string]bool)
+	add := func(name string, kind tagKind) {
+		if !seen[name] {
+			seen[name] = true
+			tags = append(tags, managedTag{name, kind})
+		}
+	}
+
+	if p.Latest {
+		add("latest", tagLatest)
+	}
+
+	if state.git {
+		branches := p.branchTags(state)
+		if len(branches) == 0 {
+			return nil, errors.New("no branch")
+		}
+
+		for _, branch := range branches {
+			add(branch, tagBranch)
+		}
+		add(state.rev, tagCommit)
+		for _, branch := range branches {
+			add(branch+"-"+state.rev, tagBranchCommit)
+		}
+		if p.Semver {
+			for _, tag := range state.tags {
+				for _, version := range semverTags(tag) {
+					add(version, tagVersion)
+				}
+			}
+		}
+	}
+
+	if custom != "" {
+		add(custom, tagCustom)
+	}
+	for _, tag := range appTags(app, tagData(p, state, custom)) {
+		add(tag, tagCustom)
+	}
+	return tags, nil
+}
+
+// remote returns the names of the tags exchanged with the remote registry:
+// the branch and version tags with branchTags, the commit tags with
+// commitTags, and the branch-commit tags with both.
+func remote(tags []managedTag, branchTags, commitTags bool) []string {
+	var names []string
+	for _, tag := range tags {
+		switch tag.kind {
+		case tagBranch, tagVersion:
+			if !branchTags {
+				continue
+			}
+		case tagCommit:
+			if !commitTags {
+				continue
+			}
+		case tagBranchCommit:
+			if !branchTags || !commitTags {
+				continue
+			}
+		}
+		names = append(names, tag.name)
+	}
+	return names
+}
+
+var invalidTagChars = regexp.MustCompile(`[^\w.-]+`)
+
+// sanitizeTag turns a branch name into a valid tag: the disallowed
+// characters are replaced with - and the tag is at most 128 characters long.
+func sanitizeTag(name string) string {
+	tag := invalidTagChars.ReplaceAllString(name, "-")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag
+}
+
+var semverRegexp = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// semverTags returns the version tags of a git tag following semantic
+// versioning: v1.2.3 gives 1, 1.2 and 1.2.3, while pre-releases such as
+// v1.2.3-rc.1 only give 1.2.3-rc.1.
+func semverTags(tag string) []string {
+	m := semverRegexp.FindStringSubmatch(tag)
+	if m == nil {
+		return nil
+	}
+	if m[4] != "" {
+		return []string{m[1] + "." + m[2] + "." + m[3] + m[4]}
+	}
+	return []string{m[1], m[1] + "." + m[2], m[1] + "." + m[2] + "." + m[3]}
+}
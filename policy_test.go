@@ -0,0 +1,97 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tagNames(tags []managedTag) []string {
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.name)
+	}
+	return names
+}
+
+func TestSanitizeTag(t *testing.T) {
+	assert.Equal(t, "master", sanitizeTag("master"))
+	assert.Equal(t, "feature-login", sanitizeTag("feature/login"))
+	assert.Equal(t, "fix-a-b", sanitizeTag("fix/a b"))
+	assert.Equal(t, "v1.2.3", sanitizeTag("v1.2.3"))
+	assert.Equal(t, "hidden", sanitizeTag(".hidden"))
+	assert.Len(t, sanitizeTag(strings.Repeat("a", 200)), 128)
+}
+
+func TestSemverTags(t *testing.T) {
+	assert.Equal(t, []string{"1", "1.2", "1.2.3"}, semverTags("v1.2.3"))
+	assert.Equal(t, []string{"0", "0.10", "0.10.0"}, semverTags("0.10.0"))
+	assert.Equal(t, []string{"1.2.3-rc.1"}, semverTags("v1.2.3-rc.1"))
+	assert.Equal(t, []string{"1", "1.2", "1.2.3"}, semverTags("v1.2.3+build.5"))
+	assert.Nil(t, semverTags("release"))
+	assert.Nil(t, semverTags("v1.2"))
+}
+
+func TestPolicyTags(t *testing.T) {
+	app := App{Name: "web", out: ioutil.Discard}
+	state := gitState{git: true, rev: "0123456", branches: []string{"feature/login"}, tags: []string{"v1.2.3"}}
+
+	tags, err := DefaultTagPolicy.tags(state, app, "custom")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"latest", "feature-login", "v1.2.3", "0123456",
+		"feature-login-0123456", "v1.2.3-0123456", "custom",
+	}, tagNames(tags))
+
+	policy := TagPolicy{Semver: true}
+	tags, err = policy.tags(state, app, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"feature/login", "v1.2.3", "0123456",
+		"feature/login-0123456", "v1.2.3-0123456", "1", "1.2", "1.2.3",
+	}, tagNames(tags))
+
+	// Without branch nor tag, only latest is known
+	_, err = DefaultTagPolicy.tags(gitState{git: true, rev: "0123456"}, app, "")
+	assert.EqualError(t, err, "no branch")
+
+	tags, err = DefaultTagPolicy.tags(gitState{}, app, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"latest"}, tagNames(tags))
+}
+
+func TestPolicyBuildTag(t *testing.T) {
+	buildTag := func(p TagPolicy, state gitState, custom string) string {
+		tag, err := p.buildTag(state, custom)
+		assert.NoError(t, err)
+		return tag
+	}
+	clean := gitState{git: true, rev: "0123456"}
+	dirty := gitState{git: true, dirty: true, rev: "0123456"}
+	assert.Equal(t, "latest", buildTag(DefaultTagPolicy, clean, ""))
+	assert.Equal(t, "latest", buildTag(DefaultTagPolicy, dirty, ""))
+	assert.Equal(t, "latest", buildTag(DefaultTagPolicy, gitState{}, ""))
+	assert.Equal(t, "0123456", buildTag(TagPolicy{}, clean, "custom"))
+
+	// Without latest, local changes are never tagged as the commit
+	assert.Equal(t, "0123456-dirty", buildTag(TagPolicy{}, dirty, ""))
+	assert.Equal(t, "custom", buildTag(TagPolicy{}, gitState{}, "custom"))
+	_, err := TagPolicy{}.buildTag(gitState{}, "")
+	assert.Error(t, err)
+}
+
+func TestRemoteTags(t *testing.T) {
+	tags := []managedTag{
+		{"latest", tagLatest},
+		{"0123456", tagCommit},
+		{"master", tagBranch},
+		{"master-0123456", tagBranchCommit},
+		{"1.2", tagVersion},
+		{"stable", tagCustom},
+	}
+	assert.Equal(t, []string{"latest", "master", "1.2", "stable"}, remote(tags, true, false))
+	assert.Equal(t, []string{"latest", "0123456", "stable"}, remote(tags, false, true))
+	assert.Equal(t, []string{"latest", "0123456", "master", "master-0123456", "1.2", "stable"}, remote(tags, true, true))
+}
@@ -1,32 +1,98 @@
 package captain // import "github.com/harbur/captain"
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
 
 func pInfo(text string, arg ...interface{}) {
+	fInfo(os.Stdout, text, arg...)
+}
+
+func pError(text string, arg ...interface{}) {
+	fError(os.Stdout, text, arg...)
+}
+
+func pDebug(text string, arg ...interface{}) {
+	fDebug(os.Stdout, text, arg...)
+}
+
+func fInfo(w io.Writer, text string, arg ...interface{}) {
 	text = colorInfo("[") + colorPrefix("CAPTAIN") + colorInfo("]") + " " + text + "\n"
 	s := arg
 	for i := range s {
 		s[i] = colorInfo(s[i])
 	}
-	fmt.Printf(text, arg...)
+	fmt.Fprintf(w, text, arg...)
 }
 
-func pError(text string, arg ...interface{}) {
+func fError(w io.Writer, text string, arg ...interface{}) {
 	text = colorErr("[") + colorPrefix("CAPTAIN") + colorErr("]") + " " + text + "\n"
 	s := arg
 	for i := range s {
 		s[i] = colorErr(s[i])
 	}
-	fmt.Printf(text, s...)
+	fmt.Fprintf(w, text, s...)
 }
 
-func pDebug(text string, arg ...interface{}) {
+func fDebug(w io.Writer, text string, arg ...interface{}) {
 	if Debug {
 		text = colorDebug("[") + colorPrefix("CAPTAIN") + colorDebug("]") + " " + text + "\n"
 		s := arg
 		for i := range s {
 			s[i] = colorDebug(s[i])
 		}
-		fmt.Printf(text, s...)
+		fmt.Fprintf(w, text, s...)
+	}
+}
+
+// prefixWriter prefixes every line written to it before forwarding it to the
+// underlying writer. Writers sharing the same mutex never interleave lines.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(mu *sync.Mutex, out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{mu: mu, out: out, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := w.writeLine(w.buf[:idx+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any pending partial line.
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := append(w.buf, '\n')
+	w.buf = nil
+	return w.writeLine(line)
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := io.WriteString(w.out, w.prefix); err != nil {
+		return err
 	}
+	_, err := w.out.Write(line)
+	return err
 }
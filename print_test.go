@@ -1,7 +1,12 @@
 package captain // import "github.com/harbur/captain"
 
 import (
+	"bytes"
+	"fmt"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestPrintInfo(t *testing.T) {
@@ -17,3 +22,16 @@ func TestPrintDebug(t *testing.T) {
 	defer func() { Debug = false }()
 	pDebug("test debug %s", "message")
 }
+
+func TestPrefixWriter(t *testing.T) {
+	var mu sync.Mutex
+	var out bytes.Buffer
+	w := newPrefixWriter(&mu, &out, "web | ")
+
+	fmt.Fprint(w, "first line\nsecond ")
+	fmt.Fprint(w, "line\nthird")
+	assert.Equal(t, "web | first line\nweb | second line\n", out.String())
+
+	w.Flush()
+	assert.Equal(t, "web | first line\nweb | second line\nweb | third\n", out.String())
+}
@@ -0,0 +1,136 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/harbur/captain/pkg/registry"
+)
+
+// PromoteOptions describes the retag of an app image to a release channel
+type PromoteOptions struct {
+	Config Config
+
+	// App is the name of the app to promote
+	App string
+
+	// From is the branch or commit whose image is promoted. It defaults to
+	// the current commit, then the current branch.
+	From string
+
+	// To is the tag of the release channel, such as stable
+	To string
+
+	Long_sha bool
+
+	// Tag_policy defines the tags the images were pushed as,
+	// DefaultTagPolicy when nil
+	Tag_policy *TagPolicy
+}
+
+// policy returns the tag policy of the options
+func (opts PromoteOptions) policy() TagPolicy {
+	if opts.Tag_policy != nil {
+		return *opts.Tag_policy
+	}
+	return DefaultTagPolicy
+}
+
+// Promote retags the image of the app built from a branch or a commit as the
+// release channel, directly in the remote registry without pulling or
+// rebuilding it.
+func Promote(opts PromoteOptions) error {
+	if opts.To == "" {
+		err := errors.New("no release channel to promote to")
+		pError(err.Error())
+		return StatusError{err, TagFailed}
+	}
+
+	apps, err := opts.Config.GetApps()
+	if err != nil {
+		return configError(err)
+	}
+	var app App
+	for _, a := range apps {
+		if a.Name == opts.App {
+			app = a
+		}
+	}
+	if app.Name == "" {
+		err := fmt.Errorf("unknown app %s", opts.App)
+		pError(err.Error())
+		return StatusError{err, InvalidCaptainYML}
+	}
+
+	sources, err := promoteSources(opts)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, NoGit}
+	}
+
+	client, repo, err := registryClient(app.Image)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, TagFailed}
+	}
+
+	for _, source := range sources {
+		m, err := client.Inspect(repo, source)
+		if err == registry.ErrNotFound {
+			pDebug("Image %s:%s not found", app.Image, source)
+			continue
+		}
+		if err != nil {
+			pError(err.Error())
+			return StatusError{err, TagFailed}
+		}
+
+		pInfo("Promoting image %s:%s to %s:%s", app.Image, source, app.Image, opts.To)
+		if err := client.PutManifest(repo, opts.To, m); err != nil {
+			pError(err.Error())
+			return StatusError{err, TagFailed}
+		}
+		return nil
+	}
+
+	err = fmt.Errorf("no image of %s found for %s", app.Image, strings.Join(sources, ", "))
+	pError(err.Error())
+	return StatusError{err, NonExistImage}
+}
+
+// promoteSources returns the captain managed tags the image to promote may be
+// pushed as, in order of preference.
+func promoteSources(opts PromoteOptions) ([]string, error) {
+	if opts.From == "" {
+		state, err := readGitState(false, opts.Long_sha)
+		if err == nil && !state.git {
+			err = errors.New("no local git repository found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		branches := opts.policy().branchTags(state)
+		if len(branches) == 0 {
+			return nil, errors.New("no branch")
+		}
+		return append([]string{state.rev}, branches...), nil
+	}
+
+	sources := []string{opts.From}
+
+	// Branches are pushed with their sanitized name
+	if tag := sanitizeTag(opts.From); opts.policy().Sanitize && tag != opts.From {
+		sources = append(sources, tag)
+	}
+
+	// A commit may have been pushed with its short or long hash
+	if hash, err := resolveCommit(opts.From); err == nil && strings.HasPrefix(hash, opts.From) {
+		for _, tag := range []string{hash[:7], hash} {
+			if tag != opts.From {
+				sources = append(sources, tag)
+			}
+		}
+	}
+	return sources, nil
+}
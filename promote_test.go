@@ -0,0 +1,104 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"testing"
+
+	"github.com/harbur/captain/pkg/registry/registrytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func promoteConfig(image string) *config {
+	return &config{
+		Apps: map[string]App{"web": {Name: "web", Build: "Dockerfile", Image: image}},
+		Path: basedir + "/test/OneImage",
+	}
+}
+
+func TestPromoteBranch(t *testing.T) {
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+	dgst := s.AddImage("harbur/test_web", "develop", "layer")
+
+	err := Promote(PromoteOptions{
+		Config: promoteConfig(s.Host() + "/harbur/test_web"),
+		App:    "web",
+		From:   "develop",
+		To:     "beta",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/test_web", "beta"))
+}
+
+func TestPromoteCommit(t *testing.T) {
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+
+	long, err := getRevision(true)
+	assert.NoError(t, err)
+	dgst := s.AddImage("harbur/test_web", long[:7], "layer")
+
+	// The long hash resolves to the image pushed with the short hash
+	err = Promote(PromoteOptions{
+		Config: promoteConfig(s.Host() + "/harbur/test_web"),
+		App:    "web",
+		From:   long,
+		To:     "stable",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/test_web", "stable"))
+}
+
+func TestPromoteCurrentCommit(t *testing.T) {
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+
+	rev, err := getRevision(false)
+	assert.NoError(t, err)
+	dgst := s.AddImage("harbur/test_web", rev, "layer")
+
+	err = Promote(PromoteOptions{
+		Config: promoteConfig(s.Host() + "/harbur/test_web"),
+		App:    "web",
+		To:     "alpha",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/test_web", "alpha"))
+}
+
+func TestPromoteMissingImage(t *testing.T) {
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+
+	err := Promote(PromoteOptions{
+		Config: promoteConfig(s.Host() + "/harbur/test_web"),
+		App:    "web",
+		From:   "develop",
+		To:     "beta",
+	})
+	assert.Error(t, err)
+	assert.Equal(t, NonExistImage, err.(StatusError).Status())
+}
+
+func TestPromoteUnknownApp(t *testing.T) {
+	err := Promote(PromoteOptions{
+		Config: promoteConfig("harbur/test_web"),
+		App:    "nonexistent",
+		To:     "beta",
+	})
+	assert.Error(t, err)
+}
+
+func TestPromoteSources(t *testing.T) {
+	sources, err := promoteSources(PromoteOptions{From: "feature/login"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"feature/login", "feature-login"}, sources)
+
+	// Branch names are kept as they are when the policy does not sanitize them
+	sources, err = promoteSources(PromoteOptions{From: "feature/login", Tag_policy: &TagPolicy{}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"feature/login"}, sources)
+}
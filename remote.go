@@ -0,0 +1,60 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"strings"
+
+	"github.com/harbur/captain/pkg/registry"
+)
+
+// RemoteTagger tags images directly in the remote registry, without a
+// Docker daemon.
+type RemoteTagger interface {
+	TagRemote(app App, from string, to string) error
+}
+
+// RemoteRegistry uploads images with the embedded Registry and tags them
+// remotely through the Registry HTTP API, so that additional tags of an
+// already pushed image only cost a manifest copy.
+type RemoteRegistry struct {
+	Registry
+}
+
+func (r *RemoteRegistry) TagRemote(app App, from string, to string) error {
+	fInfo(app.stdout(), "Tagging remote image %s:%s as %s:%s", app.Image, from, app.Image, to)
+	client, repo, err := registryClient(app.Image)
+	if err != nil {
+		return err
+	}
+	return client.Tag(repo, from, to)
+}
+
+// registryClient returns a client of the registry of the image, authenticated
+// with the resolved credentials, and the repository of the image within it.
+func registryClient(image string) (*registry.Client, string, error) {
+	auth, err := resolveAuth(image)
+	if err != nil {
+		return nil, "", err
+	}
+
+	host := registryHost(image)
+	apiHost := host
+	if host == defaultRegistry {
+		apiHost = "registry-1.docker.io"
+	}
+	return registry.New(apiHost, auth.Username, auth.Password), registryRepository(image), nil
+}
+
+// registryRepository returns the repository of the image reference within
+// its registry.
+func registryRepository(image string) string {
+	if i := strings.IndexRune(image, '/'); i >= 0 && registryHost(image) == image[:i] {
+		return image[i+1:]
+	}
+	if strings.HasPrefix(image, "index.docker.io/") || strings.HasPrefix(image, "registry-1.docker.io/") {
+		image = image[strings.IndexRune(image, '/')+1:]
+	}
+	if !strings.ContainsRune(image, '/') {
+		return "library/" + image
+	}
+	return image
+}
@@ -0,0 +1,77 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"os"
+	"testing"
+
+	"github.com/harbur/captain/pkg/registry/registrytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryRepository(t *testing.T) {
+	assert.Equal(t, "library/alpine", registryRepository("alpine"))
+	assert.Equal(t, "harbur/captain", registryRepository("harbur/captain"))
+	assert.Equal(t, "harbur/captain", registryRepository("index.docker.io/harbur/captain"))
+	assert.Equal(t, "harbur/captain", registryRepository("quay.io/harbur/captain"))
+	assert.Equal(t, "captain", registryRepository("localhost:5000/captain"))
+}
+
+func TestRemoteRegistryTag(t *testing.T) {
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+	dgst := s.AddImage("harbur/test_web", "abcdef0", "layer")
+
+	r := &RemoteRegistry{NewFakeDocker()}
+	app := App{Image: s.Host() + "/harbur/test_web"}
+	assert.NoError(t, r.TagRemote(app, "abcdef0", "master"))
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/test_web", "master"))
+
+	assert.Error(t, r.TagRemote(app, "nonexistent", "master"))
+}
+
+func TestRemoteRegistryAuth(t *testing.T) {
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+	s.Username, s.Password, s.Token = "user", "secret", "token"
+	s.AddImage("harbur/test_web", "latest", "layer")
+
+	os.Setenv("CAPTAIN_REGISTRY", s.Host())
+	os.Setenv("CAPTAIN_REGISTRY_USER", "user")
+	os.Setenv("CAPTAIN_REGISTRY_PASSWORD", "secret")
+
+	r := &RemoteRegistry{NewFakeDocker()}
+	app := App{Image: s.Host() + "/harbur/test_web"}
+	assert.NoError(t, r.TagRemote(app, "latest", "master"))
+}
+
+func TestPushRemoteTags(t *testing.T) {
+	if isDirty() {
+		t.Skip("Git repository has local changes")
+	}
+	defer withDockerConfig(t, `{}`)()
+	s := registrytest.NewServer()
+	defer s.Close()
+	dgst := s.AddImage("harbur/test_web", "latest", "layer")
+
+	image := s.Host() + "/harbur/test_web"
+	fake := NewFakeDocker(image + ":latest")
+	testConfig := &config{
+		Apps: map[string]App{"web": {Name: "web", Build: "Dockerfile", Image: image}},
+		Path: basedir + "/test/OneImage",
+	}
+	var buildOpts = BuildOptions{
+		Config:      testConfig,
+		Branch_tags: true,
+		Tag:         "custom",
+		Builder:     fake,
+		Registry:    &RemoteRegistry{fake},
+	}
+	assert.NoError(t, Push(buildOpts))
+	assert.Equal(t, []string{image + ":latest"}, fake.Pushed, "Only the first tag should be uploaded")
+
+	branches, _ := getBranches(false)
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/test_web", branches[0]))
+	assert.Equal(t, dgst, s.ManifestDigest("harbur/test_web", "custom"))
+}
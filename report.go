@@ -0,0 +1,199 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Report formats of the test results
+const (
+	ReportJUnit = "junit"
+	ReportJSON  = "json"
+)
+
+// report is a file the test results are written to
+type report struct {
+	format string
+	path   string
+}
+
+// parseReports parses the reports given as format=path.
+func parseReports(values []string) ([]report, error) {
+	var reports []report
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid report %q, expected format=path", value)
+		}
+		switch parts[0] {
+		case ReportJUnit, ReportJSON:
+		default:
+			return nil, fmt.Errorf("unknown report format %q, expected %s or %s", parts[0], ReportJUnit, ReportJSON)
+		}
+		reports = append(reports, report{parts[0], parts[1]})
+	}
+	return reports, nil
+}
+
+// writeReports writes the test results to every report.
+func writeReports(reports []report, results []TestResult) error {
+	for _, r := range reports {
+		f, err := os.Create(r.path)
+		if err != nil {
+			return err
+		}
+
+		switch r.format {
+		case ReportJUnit:
+			err = writeJUnit(f, results)
+		case ReportJSON:
+			err = writeJSON(f, results)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		pInfo("Wrote %s report of the tests to %s", r.format, r.path)
+	}
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnit writes the results as JUnit XML, with a test suite per app.
+func writeJUnit(w io.Writer, results []TestResult) error {
+	suites := junitTestSuites{Name: "captain"}
+	var total time.Duration
+	var times []time.Duration
+	for _, result := range results {
+		if len(suites.Suites) == 0 || suites.Suites[len(suites.Suites)-1].Name != result.App {
+			suites.Suites = append(suites.Suites, junitTestSuite{Name: result.App})
+			times = append(times, 0)
+		}
+		suite := &suites.Suites[len(suites.Suites)-1]
+
+		c := junitTestCase{
+			Name:      result.Command,
+			Classname: result.App,
+			Time:      seconds(result.Duration),
+			SystemOut: result.Stdout,
+			SystemErr: result.Stderr,
+		}
+		suite.Tests++
+		suites.Tests++
+		switch {
+		case result.Skipped:
+			c.Skipped = &junitMessage{result.Failure}
+			suite.Skipped++
+			suites.Skipped++
+		case result.Failed():
+			c.Failure = &junitMessage{result.Failure}
+			suite.Failures++
+			suites.Failures++
+		}
+		suite.Cases = append(suite.Cases, c)
+		times[len(times)-1] += result.Duration
+		total += result.Duration
+	}
+	for i, d := range times {
+		suites.Suites[i].Time = seconds(d)
+	}
+	suites.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type jsonReport struct {
+	Passed bool             `json:"passed"`
+	Tests  []jsonTestResult `json:"tests"`
+}
+
+type jsonTestResult struct {
+	App      string  `json:"app"`
+	Command  string  `json:"command"`
+	Duration float64 `json:"duration"`
+	Status   int     `json:"status"`
+	Attempts int     `json:"attempts"`
+	Passed   bool    `json:"passed"`
+	Skipped  bool    `json:"skipped,omitempty"`
+	Failure  string  `json:"failure,omitempty"`
+	Stdout   string  `json:"stdout"`
+	Stderr   string  `json:"stderr"`
+}
+
+// writeJSON writes the results as JSON, the durations being in seconds.
+func writeJSON(w io.Writer, results []TestResult) error {
+	r := jsonReport{Passed: true, Tests: []jsonTestResult{}}
+	for _, result := range results {
+		if result.Failure != "" {
+			r.Passed = false
+		}
+		r.Tests = append(r.Tests, jsonTestResult{
+			App:      result.App,
+			Command:  result.Command,
+			Duration: result.Duration.Seconds(),
+			Status:   result.Status,
+			Attempts: result.Attempts,
+			Passed:   result.Failure == "",
+			Skipped:  result.Skipped,
+			Failure:  result.Failure,
+			Stdout:   result.Stdout,
+			Stderr:   result.Stderr,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
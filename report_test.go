@@ -0,0 +1,124 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var reportResults = []TestResult{
+	{App: "web", Command: "echo ok", Duration: 1500 * time.Millisecond, Attempts: 1, Stdout: "ok\n"},
+	{App: "web", Command: "false", Duration: 250 * time.Millisecond, Status: 1, Attempts: 2, Stderr: "oops\n", Failure: "test exited with status 1"},
+	{App: "web", Command: "echo skipped", Status: -1, Skipped: true, Failure: "a previous test failed"},
+	{App: "backend", Command: "true", Attempts: 1},
+}
+
+func TestParseReports(t *testing.T) {
+	reports, err := parseReports([]string{"junit=out/report.xml", "json=report.json"})
+	assert.NoError(t, err)
+	assert.Equal(t, []report{{"junit", "out/report.xml"}, {"json", "report.json"}}, reports)
+
+	_, err = parseReports([]string{"report.xml"})
+	assert.EqualError(t, err, `invalid report "report.xml", expected format=path`)
+	_, err = parseReports([]string{"html=report.html"})
+	assert.EqualError(t, err, `unknown report format "html", expected junit or json`)
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var b bytes.Buffer
+	assert.NoError(t, writeJUnit(&b, reportResults))
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites name="captain" tests="4" failures="1" skipped="1" time="1.750">
+  <testsuite name="web" tests="3" failures="1" skipped="1" time="1.750">
+    <testcase name="echo ok" classname="web" time="1.500">
+      <system-out>ok&#xA;</system-out>
+    </testcase>
+    <testcase name="false" classname="web" time="0.250">
+      <failure message="test exited with status 1"></failure>
+      <system-err>oops&#xA;</system-err>
+    </testcase>
+    <testcase name="echo skipped" classname="web" time="0.000">
+      <skipped message="a previous test failed"></skipped>
+    </testcase>
+  </testsuite>
+  <testsuite name="backend" tests="1" failures="0" skipped="0" time="0.000">
+    <testcase name="true" classname="backend" time="0.000"></testcase>
+  </testsuite>
+</testsuites>
+`, b.String())
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	assert.NoError(t, writeJSON(&b, reportResults))
+
+	var r jsonReport
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &r))
+	assert.False(t, r.Passed)
+	assert.Len(t, r.Tests, 4)
+	assert.Equal(t, jsonTestResult{
+		App: "web", Command: "false", Duration: 0.25, Status: 1, Attempts: 2,
+		Failure: "test exited with status 1", Stderr: "oops\n",
+	}, r.Tests[1])
+	assert.True(t, r.Tests[3].Passed)
+}
+
+func TestTestKeepGoing(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile": "FROM scratch",
+		"captain.yml": `
+web:
+  image: harbur/web
+  test:
+    - command: exit 3
+    - echo skipped
+backend:
+  image: harbur/backend
+  test:
+    - echo backend
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	assert.NoError(t, os.Chdir(dir))
+
+	config, err := NewConfig("", "captain.yml", true, false)
+	assert.NoError(t, err)
+
+	fake := NewFakeDocker("harbur/web:latest", "harbur/backend:latest")
+	fake.Run = func(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+		io.WriteString(stderr, "failing\n")
+		return 3, nil
+	}
+	report := filepath.Join(dir, "report.json")
+	opts := BuildOptions{Config: config, Builder: fake, Registry: fake, Runner: fake, Reports: []string{"json=" + report}}
+
+	// Without --keep-going, the tests stop at the first failing app
+	assert.EqualError(t, Test(opts), "test exited with status 3")
+	var r jsonReport
+	data, err := ioutil.ReadFile(report)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &r))
+	assert.Len(t, r.Tests, 2)
+	assert.Equal(t, "failing\n", r.Tests[0].Stderr)
+	assert.True(t, r.Tests[1].Skipped)
+
+	opts.Keep_going = true
+	assert.EqualError(t, Test(opts), "tests failed for web")
+	data, err = ioutil.ReadFile(report)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &r))
+	assert.Len(t, r.Tests, 3)
+	assert.Equal(t, "backend\n", r.Tests[2].Stdout)
+	assert.True(t, r.Tests[2].Passed)
+}
@@ -0,0 +1,228 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Service is a container started before the tests of an app, such as a
+// database or a queue. The test containers reach it by its name.
+type Service struct {
+	Image   string            `yaml:"image"`
+	Command []string          `yaml:"command,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+
+	// Timeout is the maximum duration to wait for the service to be healthy
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// serviceKeys are the keys of a service
+var serviceKeys = []string{"image", "command", "env", "timeout"}
+
+// defaultServiceTimeout is the time a service has to be healthy when it
+// has no timeout.
+const defaultServiceTimeout = time.Minute
+
+// pollInterval is the interval between the checks of the state of the
+// containers started in the background.
+var pollInterval = time.Second
+
+func (s *Service) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return &nodeError{value, "invalid service, expected a mapping"}
+	}
+	if err := checkKeys(value, serviceKeys, "service"); err != nil {
+		return err
+	}
+
+	var raw struct {
+		Image   string            `yaml:"image"`
+		Command yaml.Node         `yaml:"command"`
+		Env     map[string]string `yaml:"env"`
+		Timeout string            `yaml:"timeout"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	command, err := decodeCommand(&raw.Command)
+	if err != nil {
+		return err
+	}
+	*s = Service{Image: raw.Image, Command: command, Env: raw.Env, Timeout: raw.Timeout}
+
+	if s.Image == "" {
+		return &nodeError{value, "missing image in service"}
+	}
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			return &nodeError{value, fmt.Sprintf("invalid timeout %q in service", s.Timeout)}
+		}
+	}
+	return nil
+}
+
+// timeout returns the time the service has to be healthy
+func (s Service) timeout() time.Duration {
+	if d, err := time.ParseDuration(s.Timeout); err == nil {
+		return d
+	}
+	return defaultServiceTimeout
+}
+
+// services holds the running services of an app
+type services struct {
+	runner  Runner
+	app     App
+	network string
+	ids     []string
+
+	// env holds the connection environment variables of the services
+	env []string
+}
+
+// startServices starts the services of the app on a dedicated network, in
+// order of name, and waits for each of them to be healthy. On failure, the
+// services already started are torn down.
+func startServices(ctx context.Context, runner Runner, app App) (*services, error) {
+	out := app.stdout()
+	s := &services{runner: runner, app: app, network: networkName(app.Name)}
+
+	fDebug(out, "Creating network %s", s.network)
+	if err := runner.CreateNetwork(s.network); err != nil {
+		return nil, fmt.Errorf("cannot create network %s: %s", s.network, err)
+	}
+
+	var names []string
+	for name := range app.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		service := app.Services[name]
+		fInfo(out, "Starting service %s (%s)", name, service.Image)
+		id, err := runner.StartContainer(ContainerOptions{
+			Image:   service.Image,
+			Command: service.Command,
+			Env:     envList(service.Env),
+			Network: s.network,
+			Aliases: []string{name},
+		}, out)
+		if err != nil {
+			s.stop()
+			return nil, fmt.Errorf("cannot start service %s: %s", name, err)
+		}
+		s.ids = append(s.ids, id)
+
+		state, err := waitHealthy(ctx, runner, id, service.timeout())
+		if err != nil {
+			fError(out, "Logs of service %s:", name)
+			runner.ContainerLogs(id, out, app.stderr())
+			s.stop()
+			return nil, fmt.Errorf("service %s %s", name, err)
+		}
+		s.env = append(s.env, serviceEnv(name, state)...)
+	}
+	return s, nil
+}
+
+// stop removes the containers of the services, then their network.
+func (s *services) stop() {
+	out := s.app.stdout()
+	for i := len(s.ids) - 1; i >= 0; i-- {
+		if err := s.runner.RemoveContainer(s.ids[i]); err != nil {
+			fError(out, "Could not remove the container %s of a service: %s", s.ids[i], err)
+		}
+	}
+	s.ids = nil
+
+	fDebug(out, "Removing network %s", s.network)
+	if err := s.runner.RemoveNetwork(s.network); err != nil {
+		fError(out, "Could not remove network %s: %s", s.network, err)
+	}
+}
+
+// waitHealthy waits for the container to be healthy, or only running when
+// its image has no HEALTHCHECK.
+func waitHealthy(ctx context.Context, runner Runner, id string, timeout time.Duration) (ContainerState, error) {
+	deadline := time.After(timeout)
+	for {
+		state, err := runner.InspectContainer(id)
+		if err != nil {
+			return state, err
+		}
+		switch {
+		case !state.Running:
+			return state, fmt.Errorf("exited with status %d", state.ExitCode)
+		case state.Health == "unhealthy":
+			return state, fmt.Errorf("is unhealthy")
+		case state.Health == "" || state.Health == "healthy":
+			return state, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return state, fmt.Errorf("was interrupted")
+		case <-deadline:
+			return state, fmt.Errorf("did not become healthy within %s", timeout)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+var envNameRegexp = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+// serviceEnv returns the environment variables to connect to the service:
+// <NAME>_HOST and, when the service exposes ports, <NAME>_PORT with the
+// lowest one.
+func serviceEnv(name string, state ContainerState) []string {
+	prefix := envNameRegexp.ReplaceAllString(strings.ToUpper(name), "_")
+	env := []string{prefix + "_HOST=" + name}
+	if len(state.Ports) > 0 {
+		ports := append([]string(nil), state.Ports...)
+		sort.Slice(ports, func(i, j int) bool { return portNumber(ports[i]) < portNumber(ports[j]) })
+		env = append(env, prefix+"_PORT="+strings.Split(ports[0], "/")[0])
+	}
+	return env
+}
+
+func portNumber(port string) int {
+	var n int
+	fmt.Sscanf(port, "%d", &n)
+	return n
+}
+
+// networkName returns a unique name for the network of the services of the
+// app.
+func networkName(app string) string {
+	b := make([]byte, 4)
+	io.ReadFull(rand.Reader, b)
+	return "captain-" + sanitizeTag(app) + "-" + hex.EncodeToString(b)
+}
+
+// withEnv returns the container options with the environment variables
+// added, unless already defined.
+func (opts ContainerOptions) withEnv(env []string) ContainerOptions {
+	defined := make(map[string]bool)
+	for _, e := range opts.Env {
+		defined[strings.SplitN(e, "=", 2)[0]] = true
+	}
+
+	var all []string
+	for _, e := range env {
+		if !defined[strings.SplitN(e, "=", 2)[0]] {
+			all = append(all, e)
+		}
+	}
+	opts.Env = append(all, opts.Env...)
+	return opts
+}
@@ -0,0 +1,204 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestUnmarshalService(t *testing.T) {
+	var s Service
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+image: postgres:11
+command: postgres -c fsync=off
+env:
+  POSTGRES_PASSWORD: secret
+timeout: 2m
+`), &s))
+	assert.Equal(t, Service{
+		Image:   "postgres:11",
+		Command: []string{"sh", "-c", "postgres -c fsync=off"},
+		Env:     map[string]string{"POSTGRES_PASSWORD": "secret"},
+		Timeout: "2m",
+	}, s)
+	assert.Equal(t, 2*time.Minute, s.timeout())
+	assert.Equal(t, defaultServiceTimeout, Service{}.timeout())
+}
+
+func TestValidateService(t *testing.T) {
+	errs := validateSimple(`
+web:
+  image: harbur/test_web
+  services:
+    db:
+      env:
+        A: a
+`)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 6, errs[0].Line)
+	assert.Equal(t, "app web: missing image in service", errs[0].Message)
+
+	errs = validateSimple(`
+web:
+  image: harbur/test_web
+  services:
+    db:
+      image: postgres
+      port: 5432
+`)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, `app web: unknown key "port" in service`, errs[0].Message)
+}
+
+func TestServiceEnv(t *testing.T) {
+	assert.Equal(t, []string{"DB_HOST=db"}, serviceEnv("db", ContainerState{}))
+	assert.Equal(t, []string{"MY_QUEUE_HOST=my-queue", "MY_QUEUE_PORT=80"}, serviceEnv("my-queue", ContainerState{Ports: []string{"443/tcp", "80/tcp"}}))
+}
+
+func TestWithEnv(t *testing.T) {
+	opts := ContainerOptions{Env: []string{"DB_HOST=localhost"}}
+	opts = opts.withEnv([]string{"DB_HOST=db", "DB_PORT=5432"})
+	assert.Equal(t, []string{"DB_PORT=5432", "DB_HOST=localhost"}, opts.Env)
+}
+
+// servicesApp returns an app with a database and a queue as services
+func servicesApp() App {
+	return App{
+		Name:  "web",
+		Image: "harbur/web",
+		Services: map[string]Service{
+			"db":    {Image: "postgres:11"},
+			"queue": {Image: "redis:5"},
+		},
+		Test: []TestCommand{
+			{Command: []string{"true"}, Env: map[string]string{"QUEUE_HOST": "localhost"}},
+			{Shell: "true"},
+		},
+		out: ioutil.Discard,
+	}
+}
+
+func TestTestServices(t *testing.T) {
+	fake := NewFakeDocker("harbur/web:latest")
+	fake.State = func(opts ContainerOptions) ContainerState {
+		if opts.Image == "postgres:11" {
+			return ContainerState{Running: true, Health: "healthy", Ports: []string{"5432/tcp"}}
+		}
+		return ContainerState{Running: true}
+	}
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+
+	results := testApp(context.Background(), opts, servicesApp(), "harbur/web:latest")
+	assert.Len(t, results, 2)
+	assert.False(t, results[0].Failed())
+	assert.False(t, results[1].Failed())
+
+	assert.Len(t, fake.Started, 2)
+	assert.Equal(t, []string{"db"}, fake.Started[0].Aliases)
+	assert.Equal(t, []string{"queue"}, fake.Started[1].Aliases)
+
+	network := fake.Started[0].Network
+	assert.Contains(t, network, "captain-web-")
+	assert.Equal(t, network, fake.Ran[0].Network)
+	assert.Equal(t, []string{"DB_HOST=db", "DB_PORT=5432", "QUEUE_HOST=localhost"}, fake.Ran[0].Env)
+
+	// The services are torn down after the tests
+	assert.Len(t, fake.Stopped, 2)
+	assert.Empty(t, fake.Networks)
+}
+
+func TestTestServicesShellTests(t *testing.T) {
+	fake := NewFakeDocker("harbur/web:latest")
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+	app := servicesApp()
+	app.Test = []TestCommand{{Shell: "true"}}
+
+	// Shell tests run on the host, without the services
+	results := testApp(context.Background(), opts, app, "harbur/web:latest")
+	assert.Len(t, results, 1)
+	assert.False(t, results[0].Failed())
+	assert.Empty(t, fake.Started)
+	assert.Empty(t, fake.Networks)
+}
+
+func TestTestServicesUnhealthy(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	fake := NewFakeDocker("harbur/web:latest")
+	checks := 0
+	fake.State = func(opts ContainerOptions) ContainerState {
+		if opts.Image == "redis:5" {
+			if checks++; checks > 2 {
+				return ContainerState{Running: true, Health: "unhealthy"}
+			}
+			return ContainerState{Running: true, Health: "starting"}
+		}
+		return ContainerState{Running: true}
+	}
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+
+	results := testApp(context.Background(), opts, servicesApp(), "harbur/web:latest")
+	assert.Len(t, results, 3)
+	assert.Equal(t, "start services", results[0].Command)
+	assert.Equal(t, "service queue is unhealthy", results[0].Failure)
+	assert.True(t, results[1].Skipped)
+	assert.True(t, results[2].Skipped)
+
+	assert.Empty(t, fake.Ran)
+	assert.Len(t, fake.Stopped, 2)
+	assert.Empty(t, fake.Networks)
+
+	// A service which does not become healthy in time fails as well
+	app := servicesApp()
+	app.Services["queue"] = Service{Image: "redis:5", Timeout: "5ms"}
+	checks = -1000
+	results = testApp(context.Background(), opts, app, "harbur/web:latest")
+	assert.Equal(t, "service queue did not become healthy within 5ms", results[0].Failure)
+	assert.Empty(t, fake.Networks)
+}
+
+func TestTestServicesInterrupted(t *testing.T) {
+	fake := NewFakeDocker("harbur/web:latest")
+	ctx, cancel := context.WithCancel(context.Background())
+	fake.Run = func(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+		cancel()
+		<-ctx.Done()
+		return -1, ctx.Err()
+	}
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+
+	results := testApp(ctx, opts, servicesApp(), "harbur/web:latest")
+	assert.Len(t, results, 2)
+	assert.Equal(t, "test was interrupted", results[0].Failure)
+	assert.Equal(t, "the tests were interrupted", results[1].Failure)
+	assert.Empty(t, fake.Networks)
+	assert.Len(t, fake.Stopped, 2)
+}
+
+func TestTestContext(t *testing.T) {
+	fake := NewFakeDocker("harbur/web:latest")
+	ctx, cancel := context.WithCancel(context.Background())
+	fake.Run = func(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+		cancel()
+		<-ctx.Done()
+		return -1, ctx.Err()
+	}
+	opts := BuildOptions{
+		Config:     &config{Apps: map[string]App{"web": servicesApp()}},
+		Keep_going: true,
+		Context:    ctx,
+		Builder:    fake,
+		Registry:   fake,
+		Runner:     fake,
+	}
+
+	// Canceling the context of the options stops the tests
+	assert.EqualError(t, Test(opts), "tests interrupted")
+	assert.Empty(t, fake.Networks)
+}
@@ -0,0 +1,233 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Smoke starts a container of the image of an app and probes it, to check
+// that the image starts and becomes ready.
+type Smoke struct {
+	// Ports are published on random ports of the Docker host for the probes
+	Ports   []string          `yaml:"ports,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Command []string          `yaml:"command,omitempty"`
+
+	// Http is the path requested on the first port, which must answer with
+	// a status lower than 400
+	Http string `yaml:"http,omitempty"`
+
+	// Tcp is the port that must accept connections
+	Tcp string `yaml:"tcp,omitempty"`
+
+	// Timeout is the maximum duration to wait for the container to be ready
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// smokeKeys are the keys of a smoke test
+var smokeKeys = []string{"ports", "env", "command", "http", "tcp", "timeout"}
+
+// defaultSmokeTimeout is the time a smoke test has to be ready when it has
+// no timeout.
+const defaultSmokeTimeout = time.Minute
+
+// probeTimeout is the timeout of a single probe of a smoke test
+const probeTimeout = 2 * time.Second
+
+func (s *Smoke) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return &nodeError{value, "invalid smoke, expected a mapping"}
+	}
+	if err := checkKeys(value, smokeKeys, "smoke"); err != nil {
+		return err
+	}
+
+	var raw struct {
+		Ports   []string          `yaml:"ports"`
+		Env     map[string]string `yaml:"env"`
+		Command yaml.Node         `yaml:"command"`
+		Http    string            `yaml:"http"`
+		Tcp     string            `yaml:"tcp"`
+		Timeout string            `yaml:"timeout"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	command, err := decodeCommand(&raw.Command)
+	if err != nil {
+		return err
+	}
+	*s = Smoke{Env: raw.Env, Command: command, Http: raw.Http, Tcp: raw.Tcp, Timeout: raw.Timeout}
+
+	for _, port := range raw.Ports {
+		if !portRegexp.MatchString(port) {
+			return &nodeError{value, fmt.Sprintf("invalid port %q in smoke, expected a port such as 8080/tcp", port)}
+		}
+		s.Ports = append(s.Ports, normalizePort(port))
+	}
+	if s.Http != "" {
+		if !strings.HasPrefix(s.Http, "/") {
+			return &nodeError{value, fmt.Sprintf("invalid http %q in smoke, expected a path such as /healthz", s.Http)}
+		}
+		if len(s.Ports) == 0 || !strings.HasSuffix(s.Ports[0], "/tcp") {
+			return &nodeError{value, "http of smoke requires a TCP port in ports"}
+		}
+	}
+	if s.Tcp != "" {
+		if !portRegexp.MatchString(s.Tcp) || !contains(s.Ports, normalizePort(s.Tcp)) {
+			return &nodeError{value, fmt.Sprintf("tcp %q of smoke must be one of its ports", s.Tcp)}
+		}
+	}
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			return &nodeError{value, fmt.Sprintf("invalid timeout %q in smoke", s.Timeout)}
+		}
+	}
+	return nil
+}
+
+// normalizePort adds the tcp protocol to a port without one
+func normalizePort(port string) string {
+	if !strings.Contains(port, "/") {
+		return port + "/tcp"
+	}
+	return port
+}
+
+// timeout returns the time the container has to be ready
+func (s Smoke) timeout() time.Duration {
+	if d, err := time.ParseDuration(s.Timeout); err == nil {
+		return d
+	}
+	return defaultSmokeTimeout
+}
+
+// runSmoke starts a container of the image and waits for it to be ready,
+// according to the probes of the smoke test or to the HEALTHCHECK of the
+// image. The container is always removed, and its logs are attached to the
+// result on failure.
+func runSmoke(ctx context.Context, opts BuildOptions, app App, image string) (result TestResult) {
+	out := app.stdout()
+	smoke := *app.Smoke
+	result = TestResult{App: app.Name, Command: "smoke", Attempts: 1}
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	fInfo(out, "Running smoke test of %s", image)
+	id, err := opts.Runner.StartContainer(ContainerOptions{
+		Image:   image,
+		Command: smoke.Command,
+		Env:     envList(smoke.Env),
+		Ports:   smoke.Ports,
+	}, out)
+	if err != nil {
+		result.Status, result.Failure = -1, err.Error()
+		return result
+	}
+	defer func() {
+		if err := opts.Runner.RemoveContainer(id); err != nil {
+			fError(out, "Could not remove container %s: %s", id, err)
+		}
+	}()
+
+	state, err := waitReady(ctx, opts.Runner, id, smoke)
+	if err == nil {
+		fInfo(out, "Smoke test of %s passed", image)
+		return result
+	}
+
+	result.Status, result.Failure = -1, err.Error()
+	if !state.Running {
+		result.Status = state.ExitCode
+	}
+	var stdout, stderr bytes.Buffer
+	if err := opts.Runner.ContainerLogs(id, &stdout, &stderr); err != nil {
+		fError(out, "Could not get the logs of the container: %s", err)
+	}
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	fError(out, "Smoke test of %s failed: %s, logs of the container:", image, err)
+	out.Write(stdout.Bytes())
+	app.stderr().Write(stderr.Bytes())
+	return result
+}
+
+// waitReady waits for the container to pass the probes of the smoke test,
+// or to be healthy when it has none.
+func waitReady(ctx context.Context, runner Runner, id string, smoke Smoke) (ContainerState, error) {
+	deadline := time.After(smoke.timeout())
+	for {
+		state, err := runner.InspectContainer(id)
+		if err != nil {
+			return state, err
+		}
+		if !state.Running {
+			return state, fmt.Errorf("the container exited early with status %d", state.ExitCode)
+		}
+		if state.Health == "unhealthy" {
+			return state, fmt.Errorf("the container is unhealthy")
+		}
+
+		ready, err := probe(state, smoke)
+		if err != nil {
+			return state, err
+		}
+		if ready {
+			return state, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return state, fmt.Errorf("the smoke test was interrupted")
+		case <-deadline:
+			return state, fmt.Errorf("the container was not ready within %s", smoke.timeout())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// probe reports whether the running container is ready. Without probe, the
+// container must be healthy according to its HEALTHCHECK.
+func probe(state ContainerState, smoke Smoke) (bool, error) {
+	if smoke.Http == "" && smoke.Tcp == "" {
+		if state.Health == "" {
+			return false, fmt.Errorf("the smoke test has no probe and the image has no HEALTHCHECK")
+		}
+		return state.Health == "healthy", nil
+	}
+
+	if smoke.Tcp != "" {
+		address, ok := state.Published[normalizePort(smoke.Tcp)]
+		if !ok {
+			return false, fmt.Errorf("port %s is not published", smoke.Tcp)
+		}
+		conn, err := net.DialTimeout("tcp", address, probeTimeout)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+	}
+
+	if smoke.Http != "" {
+		address, ok := state.Published[smoke.Ports[0]]
+		if !ok {
+			return false, fmt.Errorf("port %s is not published", smoke.Ports[0])
+		}
+		client := http.Client{Timeout: probeTimeout}
+		resp, err := client.Get("http://" + address + smoke.Http)
+		if err != nil {
+			return false, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,159 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestUnmarshalSmoke(t *testing.T) {
+	var s Smoke
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+ports:
+  - 8080
+  - 9090/tcp
+env:
+  PORT: "8080"
+http: /healthz
+tcp: 9090
+timeout: 30s
+`), &s))
+	assert.Equal(t, Smoke{
+		Ports:   []string{"8080/tcp", "9090/tcp"},
+		Env:     map[string]string{"PORT": "8080"},
+		Http:    "/healthz",
+		Tcp:     "9090",
+		Timeout: "30s",
+	}, s)
+	assert.Equal(t, 30*time.Second, s.timeout())
+}
+
+func TestValidateSmoke(t *testing.T) {
+	for data, message := range map[string]string{
+		"{http: /healthz}":                "app web: http of smoke requires a TCP port in ports",
+		"{ports: [8080], http: healthz}":  `app web: invalid http "healthz" in smoke, expected a path such as /healthz`,
+		"{ports: [8080], tcp: 9090}":      `app web: tcp "9090" of smoke must be one of its ports`,
+		"{ports: [http]}":                 `app web: invalid port "http" in smoke, expected a port such as 8080/tcp`,
+		"{ports: [8080], timeout: never}": `app web: invalid timeout "never" in smoke`,
+		"{port: 8080}":                    `app web: unknown key "port" in smoke`,
+	} {
+		errs := validateSimple(`
+web:
+  image: harbur/test_web
+  smoke: ` + data + `
+`)
+		if assert.Len(t, errs, 1, data) {
+			assert.Equal(t, message, errs[0].Message)
+		}
+	}
+}
+
+// smokeApp returns an app whose smoke test probes /healthz on port 8080
+func smokeApp() App {
+	return App{
+		Name:  "web",
+		Image: "harbur/web",
+		Smoke: &Smoke{Ports: []string{"8080/tcp"}, Http: "/healthz", Timeout: "1s"},
+		Test:  []TestCommand{{Shell: "true"}},
+		out:   ioutil.Discard,
+	}
+}
+
+func TestSmoke(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	// The server is ready after a few requests
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; r.URL.Path != "/healthz" || requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	fake := NewFakeDocker("harbur/web:latest")
+	fake.State = func(opts ContainerOptions) ContainerState {
+		return ContainerState{Running: true, Published: map[string]string{"8080/tcp": strings.TrimPrefix(server.URL, "http://")}}
+	}
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+
+	results := testApp(context.Background(), opts, smokeApp(), "harbur/web:latest")
+	assert.Len(t, results, 2)
+	assert.Equal(t, "smoke", results[0].Command)
+	assert.False(t, results[0].Failed())
+	assert.False(t, results[1].Failed())
+	assert.Equal(t, 3, requests)
+
+	assert.Len(t, fake.Started, 1)
+	assert.Equal(t, []string{"8080/tcp"}, fake.Started[0].Ports)
+	assert.Len(t, fake.Stopped, 1)
+
+	// TCP probes only need the port to accept connections
+	app := smokeApp()
+	app.Smoke = &Smoke{Ports: []string{"8080/tcp"}, Tcp: "8080"}
+	result := runSmoke(context.Background(), opts, app, "harbur/web:latest")
+	assert.False(t, result.Failed())
+}
+
+func TestSmokeFailures(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	published := map[string]string{"8080/tcp": strings.TrimPrefix(server.URL, "http://")}
+
+	fake := NewFakeDocker("harbur/web:latest")
+	opts := BuildOptions{Config: &config{}, Runner: fake}
+
+	// The container exits early
+	fake.State = func(opts ContainerOptions) ContainerState {
+		return ContainerState{ExitCode: 3}
+	}
+	results := testApp(context.Background(), opts, smokeApp(), "harbur/web:latest")
+	assert.Len(t, results, 2)
+	assert.Equal(t, "the container exited early with status 3", results[0].Failure)
+	assert.Equal(t, 3, results[0].Status)
+	assert.Equal(t, "logs of harbur/web:latest\n", results[0].Stdout)
+	assert.Equal(t, "the smoke test failed", results[1].Failure)
+	assert.Len(t, fake.Stopped, 1)
+
+	// The container never answers the probe
+	fake.State = func(opts ContainerOptions) ContainerState {
+		return ContainerState{Running: true, Published: published}
+	}
+	app := smokeApp()
+	app.Smoke.Timeout = "20ms"
+	result := runSmoke(context.Background(), opts, app, "harbur/web:latest")
+	assert.Equal(t, "the container was not ready within 20ms", result.Failure)
+	assert.Equal(t, "logs of harbur/web:latest\n", result.Stdout)
+
+	// Without probe, the HEALTHCHECK of the image is required
+	app.Smoke = &Smoke{}
+	result = runSmoke(context.Background(), opts, app, "harbur/web:latest")
+	assert.Equal(t, "the smoke test has no probe and the image has no HEALTHCHECK", result.Failure)
+
+	fake.State = func(opts ContainerOptions) ContainerState {
+		return ContainerState{Running: true, Health: "unhealthy"}
+	}
+	result = runSmoke(context.Background(), opts, app, "harbur/web:latest")
+	assert.Equal(t, "the container is unhealthy", result.Failure)
+
+	fake.State = func(opts ContainerOptions) ContainerState {
+		return ContainerState{Running: true, Health: "healthy"}
+	}
+	result = runSmoke(context.Background(), opts, app, "harbur/web:latest")
+	assert.False(t, result.Failed())
+	assert.Empty(t, result.Stdout)
+	assert.Len(t, fake.Stopped, 5)
+}
@@ -0,0 +1,77 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"text/template"
+)
+
+// tagRegexp matches the valid tags of an image reference
+var tagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// tagData returns the values available to the tags templates of the apps:
+// Tag (the user-defined tag), Branch, SHA, ShortSHA and GitTag. Values which
+// are unknown, e.g. without git repository, are left out. With several
+// branches, one set of values is returned per branch.
+func tagData(p TagPolicy, state gitState, custom string) []map[string]string {
+	base := make(map[string]string)
+	if custom != "" {
+		base["Tag"] = custom
+	}
+	if state.sha != "" {
+		base["SHA"] = state.sha
+		base["ShortSHA"] = state.sha[:7]
+	}
+	if len(state.tags) > 0 {
+		base["GitTag"] = state.tags[0]
+	}
+
+	var data []map[string]string
+	for _, branch := range state.branches {
+		if p.Sanitize {
+			branch = sanitizeTag(branch)
+		}
+		d := map[string]string{"Branch": branch}
+		for k, v := range base {
+			d[k] = v
+		}
+		data = append(data, d)
+	}
+	if len(data) == 0 {
+		return []map[string]string{base}
+	}
+	return data
+}
+
+// appTags renders the tags templates of the app. A template referencing an
+// unknown value, such as {{.GitTag}} on a commit without git tag, or
+// rendering an invalid tag is skipped.
+func appTags(app App, data []map[string]string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, text := range app.Tags {
+		tmpl, err := template.New("tag").Option("missingkey=error").Parse(text)
+		if err != nil {
+			fError(app.stdout(), "Invalid tag %s of %s: %s", strconv.Quote(text), app.Name, err)
+			continue
+		}
+		for _, d := range data {
+			var b bytes.Buffer
+			if err := tmpl.Execute(&b, d); err != nil {
+				fDebug(app.stdout(), "Skipping tag %s of %s: %s", strconv.Quote(text), app.Name, err)
+				continue
+			}
+			tag := b.String()
+			if !tagRegexp.MatchString(tag) {
+				fInfo(app.stdout(), "Skipping tag %s of %s - invalid tag %s", strconv.Quote(text), app.Name, strconv.Quote(tag))
+				continue
+			}
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
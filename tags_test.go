@@ -0,0 +1,75 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppTags(t *testing.T) {
+	app := App{Name: "web", Tags: []string{
+		"stable",
+		"v{{.Tag}}",
+		"{{.Branch}}-{{.ShortSHA}}",
+		"{{.GitTag}}",
+		"{{.Branch}}",
+		"stable",
+	}, out: ioutil.Discard}
+
+	data := []map[string]string{
+		{"Tag": "1.0", "Branch": "master", "ShortSHA": "0123456"},
+		{"Tag": "1.0", "Branch": "feature/x", "ShortSHA": "0123456"},
+	}
+	assert.Equal(t, []string{"stable", "v1.0", "master-0123456", "master"}, appTags(app, data))
+	assert.Equal(t, []string{"stable"}, appTags(app, []map[string]string{{}}))
+}
+
+func TestRemoteTagsOfApp(t *testing.T) {
+	if !isGit() {
+		t.Skip("not a git repository")
+	}
+	branches, err := getBranches(false)
+	if err != nil {
+		t.Skip("no branch")
+	}
+
+	app := App{Name: "web", Tags: []string{"stable", "{{.Branch}}-x"}, out: ioutil.Discard}
+	tags, err := remoteTags(BuildOptions{Branch_tags: true}, app)
+	assert.NoError(t, err)
+	assert.Contains(t, tags, "stable")
+	assert.Contains(t, tags, branches[0]+"-x")
+}
+
+func TestBuildTagsAndLabels(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile": "FROM scratch",
+		"captain.yml": `
+web:
+  image: harbur/web
+  labels:
+    team: platform
+  tags:
+    - stable
+    - v{{.Tag}}
+    - "{{.Branch}}"
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	assert.NoError(t, os.Chdir(dir))
+
+	config, err := NewConfig("", "captain.yml", true, false)
+	assert.NoError(t, err)
+
+	fake := NewFakeDocker()
+	assert.NoError(t, Build(BuildOptions{Config: config, Tag: "1.0", Builder: fake, Registry: fake}))
+	assert.Equal(t, []string{"1.0", "latest", "stable", "v1.0"}, fake.Tags("harbur/web"))
+
+	labels := fake.labels[fake.images["harbur/web:latest"]]
+	assert.Equal(t, "platform", labels["team"])
+	assert.NotEmpty(t, labels[contextHashLabel])
+}
@@ -0,0 +1,358 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TestCommand is an entry of the test section of an app. It is either a
+// shell command run on the host, or a command run in a container of the
+// image of the app.
+type TestCommand struct {
+	// Shell is the command run on the host with bash
+	Shell string `yaml:"-"`
+
+	// Command is run in the container. Given as a string, it is run with
+	// sh -c, given as a list, it is run as is.
+	Command []string          `yaml:"command"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Volumes []string          `yaml:"volumes,omitempty"`
+	Workdir string            `yaml:"workdir,omitempty"`
+	Timeout string            `yaml:"timeout,omitempty"`
+	Retries int               `yaml:"retries,omitempty"`
+}
+
+// testCommandKeys are the keys of a container test
+var testCommandKeys = []string{"command", "env", "volumes", "workdir", "timeout", "retries"}
+
+// nodeError reports an invalid value nested in an app of captain.yml, at the
+// position of its node.
+type nodeError struct {
+	node    *yaml.Node
+	message string
+}
+
+func (e *nodeError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.node.Line, e.message)
+}
+
+func (t *TestCommand) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = TestCommand{Shell: value.Value}
+		return nil
+	}
+	if value.Kind != yaml.MappingNode {
+		return &nodeError{value, "invalid entry in test, expected a command or a mapping"}
+	}
+
+	if err := checkKeys(value, testCommandKeys, "test"); err != nil {
+		return err
+	}
+
+	var raw struct {
+		Command yaml.Node         `yaml:"command"`
+		Env     map[string]string `yaml:"env"`
+		Volumes []string          `yaml:"volumes"`
+		Workdir string            `yaml:"workdir"`
+		Timeout string            `yaml:"timeout"`
+		Retries int               `yaml:"retries"`
+	}
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	*t = TestCommand{
+		Env:     raw.Env,
+		Volumes: raw.Volumes,
+		Workdir: raw.Workdir,
+		Timeout: raw.Timeout,
+		Retries: raw.Retries,
+	}
+
+	command, err := decodeCommand(&raw.Command)
+	if err != nil {
+		return err
+	}
+	t.Command = command
+	if len(t.Command) == 0 {
+		return &nodeError{value, "missing command in test"}
+	}
+
+	if t.Timeout != "" {
+		if _, err := time.ParseDuration(t.Timeout); err != nil {
+			return &nodeError{value, fmt.Sprintf("invalid timeout %q in test", t.Timeout)}
+		}
+	}
+	if t.Retries < 0 {
+		return &nodeError{value, "negative retries in test"}
+	}
+	return nil
+}
+
+// checkKeys returns a nodeError for the first key of the mapping which is
+// not one of keys.
+func checkKeys(value *yaml.Node, keys []string, what string) error {
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key := value.Content[i]
+		if !contains(keys, key.Value) {
+			return &nodeError{key, fmt.Sprintf("unknown key %q in %s", key.Value, what)}
+		}
+	}
+	return nil
+}
+
+// decodeCommand decodes a command given as a string, which is run with
+// sh -c, or as a list, which is run as is.
+func decodeCommand(node *yaml.Node) ([]string, error) {
+	var command []string
+	switch node.Kind {
+	case yaml.ScalarNode:
+		command = []string{"sh", "-c", node.Value}
+	case yaml.SequenceNode:
+		if err := node.Decode(&command); err != nil {
+			return nil, err
+		}
+	}
+	return command, nil
+}
+
+// envList returns the environment variables as KEY=value, sorted by key.
+func envList(env map[string]string) []string {
+	var list []string
+	for _, k := range sortedKeys(env) {
+		list = append(list, k+"="+env[k])
+	}
+	return list
+}
+
+// String returns the command of the test as written in captain.yml.
+func (t TestCommand) String() string {
+	if t.Shell != "" {
+		return t.Shell
+	}
+	if len(t.Command) == 3 && t.Command[0] == "sh" && t.Command[1] == "-c" {
+		return t.Command[2]
+	}
+	return strings.Join(t.Command, " ")
+}
+
+// containerOptions returns the options of the container running the test
+// against image. Relative volume paths are resolved from dir.
+func (t TestCommand) containerOptions(image, dir string) ContainerOptions {
+	opts := ContainerOptions{
+		Image:   image,
+		Command: t.Command,
+		Env:     envList(t.Env),
+		Workdir: t.Workdir,
+	}
+
+	for _, volume := range t.Volumes {
+		parts := strings.SplitN(volume, ":", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], ".") {
+			volume = filepath.Join(dir, parts[0]) + ":" + parts[1]
+			if abs, err := filepath.Abs(volume); err == nil {
+				volume = abs
+			}
+		}
+		opts.Volumes = append(opts.Volumes, volume)
+	}
+	return opts
+}
+
+// TestResult is the outcome of a test command of an app
+type TestResult struct {
+	App      string
+	Command  string
+	Duration time.Duration
+
+	// Status is the exit status of the command, -1 when it did not exit
+	Status   int
+	Attempts int
+	Stdout   string
+	Stderr   string
+
+	// Failure is the reason of the failure, empty when the test passed
+	Failure string
+
+	// Skipped is set when the test did not run, Failure telling why
+	Skipped bool
+}
+
+// Failed reports whether the test ran and failed
+func (r TestResult) Failed() bool {
+	return r.Failure != "" && !r.Skipped
+}
+
+// testApp evaluates the checks of the app against image and runs its smoke
+// test, then runs its tests in order, container tests running against image.
+// The services of the app are started before its container tests and always
+// torn down.
+// The tests following a failure, or run once ctx is done, are skipped.
+func testApp(ctx context.Context, opts BuildOptions, app App, image string) []TestResult {
+	out := app.stdout()
+
+	var results []TestResult
+	var sidecars *services
+	skipped := ""
+	if !app.Checks.empty() {
+		results = runChecks(ctx, opts, app, image)
+		for _, result := range results {
+			if result.Failed() {
+				skipped = "a check of the image failed"
+			}
+		}
+	}
+
+	if app.Smoke != nil && skipped == "" {
+		result := runSmoke(ctx, opts, app, image)
+		if result.Failed() {
+			skipped = "the smoke test failed"
+		}
+		results = append(results, result)
+	}
+
+	// The services are only reachable from container tests
+	if len(app.Services) > 0 && hasContainerTests(app) && skipped == "" {
+		start := time.Now()
+		s, err := startServices(ctx, opts.Runner, app)
+		if err != nil {
+			fError(out, err.Error())
+			results = append(results, TestResult{App: app.Name, Command: "start services", Duration: time.Since(start), Status: -1, Attempts: 1, Failure: err.Error()})
+			skipped = "the services did not start"
+		} else {
+			sidecars = s
+			defer sidecars.stop()
+		}
+	}
+
+	for _, test := range app.Test {
+		if ctx.Err() != nil && skipped == "" {
+			skipped = "the tests were interrupted"
+		}
+		if skipped != "" {
+			results = append(results, TestResult{App: app.Name, Command: test.String(), Status: -1, Skipped: true, Failure: skipped})
+			continue
+		}
+
+		fInfo(out, "Running test command: %s", test)
+		var result TestResult
+		if test.Shell != "" {
+			result = runShellTest(app, test)
+		} else {
+			result = runTest(ctx, opts, app, image, test, sidecars)
+		}
+		if result.Failed() && ctx.Err() != nil {
+			skipped = "the tests were interrupted"
+		} else if result.Failed() {
+			skipped = "a previous test failed"
+			fError(out, "Test of %s failed: %s", app.Name, result.Failure)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// hasContainerTests reports whether some tests of the app run in containers.
+func hasContainerTests(app App) bool {
+	for _, test := range app.Test {
+		if test.Shell == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// runShellTest runs the test on the host with bash
+func runShellTest(app App, test TestCommand) TestResult {
+	result := TestResult{App: app.Name, Command: test.String(), Attempts: 1}
+	var stdout, stderr bytes.Buffer
+
+	start := time.Now()
+	err := executeWithStreams(io.MultiWriter(app.stdout(), &stdout), io.MultiWriter(app.stderr(), &stderr), "bash", "-c", test.Shell)
+	result.Duration = time.Since(start)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+
+	switch err := err.(type) {
+	case nil:
+	case *exec.ExitError:
+		result.Status = err.ExitCode()
+		result.Failure = fmt.Sprintf("test exited with status %d", result.Status)
+	default:
+		result.Status = -1
+		result.Failure = err.Error()
+	}
+	return result
+}
+
+// runTest runs the container test against the image, retrying it on failure
+// as many times as configured. The container is attached to the network of
+// the services, if any.
+func runTest(ctx context.Context, opts BuildOptions, app App, image string, test TestCommand, sidecars *services) TestResult {
+	out := app.stdout()
+	run := test.containerOptions(image, opts.Config.GetPath())
+	if sidecars != nil {
+		run = run.withEnv(sidecars.env)
+		run.Network = sidecars.network
+	}
+	result := TestResult{App: app.Name, Command: test.String()}
+	var stdout, stderr bytes.Buffer
+
+	start := time.Now()
+	for attempt := 0; attempt <= test.Retries; attempt++ {
+		if attempt > 0 {
+			fError(out, "%s", result.Failure)
+			fInfo(out, "Retrying test command (%s): %s", fmt.Sprintf("%d/%d", attempt, test.Retries), test)
+		}
+		result.Attempts++
+		result.Status, result.Failure = runTestOnce(ctx, opts.Runner, run, test.Timeout, io.MultiWriter(out, &stdout), io.MultiWriter(app.stderr(), &stderr))
+		if result.Failure == "" || ctx.Err() != nil {
+			break
+		}
+	}
+	result.Duration = time.Since(start)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	return result
+}
+
+// runTestOnce runs the container of a test, returning its exit status and
+// the reason of its failure.
+func runTestOnce(ctx context.Context, runner Runner, run ContainerOptions, timeout string, stdout, stderr io.Writer) (int, string) {
+	parent := ctx
+	if timeout != "" {
+		d, _ := time.ParseDuration(timeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	code, err := runner.RunContainer(ctx, run, stdout, stderr)
+	if parent.Err() != nil {
+		return -1, "test was interrupted"
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, fmt.Sprintf("test timed out after %s", timeout)
+	}
+	if err != nil {
+		return -1, err.Error()
+	}
+	if code != 0 {
+		return code, fmt.Sprintf("test exited with status %d", code)
+	}
+	return 0, ""
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
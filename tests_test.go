@@ -0,0 +1,129 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestUnmarshalTestCommand(t *testing.T) {
+	var tests []TestCommand
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+- echo on the host
+- command: go test ./...
+  env:
+    CGO_ENABLED: "0"
+  volumes:
+    - ./testdata:/testdata:ro
+  workdir: /src
+  timeout: 5m
+  retries: 2
+- command: [/app, --self-test]
+`), &tests))
+
+	assert.Equal(t, []TestCommand{
+		{Shell: "echo on the host"},
+		{
+			Command: []string{"sh", "-c", "go test ./..."},
+			Env:     map[string]string{"CGO_ENABLED": "0"},
+			Volumes: []string{"./testdata:/testdata:ro"},
+			Workdir: "/src",
+			Timeout: "5m",
+			Retries: 2,
+		},
+		{Command: []string{"/app", "--self-test"}},
+	}, tests)
+	assert.Equal(t, "go test ./...", tests[1].String())
+	assert.Equal(t, "/app --self-test", tests[2].String())
+}
+
+func TestValidateTestCommand(t *testing.T) {
+	errs := validateSimple(`
+web:
+  image: harbur/test_web
+  test:
+    - command: true
+      timout: 5m
+`)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, 6, errs[0].Line)
+	assert.Equal(t, `app web: unknown key "timout" in test`, errs[0].Message)
+
+	errs = validateSimple(`
+web:
+  image: harbur/test_web
+  test:
+    - command: true
+      timeout: soon
+    - env:
+        A: a
+`)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, `app web: invalid timeout "soon" in test`, errs[0].Message)
+}
+
+func TestContainerOptions(t *testing.T) {
+	test := TestCommand{
+		Command: []string{"true"},
+		Env:     map[string]string{"B": "b", "A": "a"},
+		Volumes: []string{"./data:/data", "/tmp:/tmp", "cache:/cache"},
+	}
+	opts := test.containerOptions("harbur/web:latest", "/src")
+	assert.Equal(t, []string{"A=a", "B=b"}, opts.Env)
+	assert.Equal(t, []string{"/src/data:/data", "/tmp:/tmp", "cache:/cache"}, opts.Volumes)
+}
+
+func TestContainerTests(t *testing.T) {
+	dir := tempContext(t, map[string]string{
+		"Dockerfile": "FROM scratch",
+		"captain.yml": `
+web:
+  image: harbur/web
+  test:
+    - command: [/app, --self-test]
+      env:
+        MODE: test
+      retries: 1
+    - command: sleep 10
+      timeout: 10ms
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	assert.NoError(t, os.Chdir(dir))
+
+	config, err := NewConfig("", "captain.yml", true, false)
+	assert.NoError(t, err)
+
+	// The first attempt fails and is retried, the second test times out
+	attempts := 0
+	fake := NewFakeDocker("harbur/web:latest")
+	fake.Run = func(ctx context.Context, opts ContainerOptions, stdout, stderr io.Writer) (int, error) {
+		if opts.Command[0] == "sh" {
+			<-ctx.Done()
+			return -1, ctx.Err()
+		}
+		attempts++
+		return 2 - attempts, nil
+	}
+	opts := BuildOptions{Config: config, Builder: fake, Registry: fake, Runner: fake}
+
+	err = Test(opts)
+	assert.Error(t, err)
+	assert.Equal(t, ExecuteFailed, err.(StatusError).Status())
+	assert.EqualError(t, err, "test timed out after 10ms")
+	assert.Len(t, fake.Ran, 3)
+	assert.Equal(t, "harbur/web:latest", fake.Ran[0].Image)
+	assert.Equal(t, []string{"MODE=test"}, fake.Ran[0].Env)
+
+	// Without image, the test fails
+	fake = NewFakeDocker()
+	opts = BuildOptions{Config: config, Builder: fake, Registry: fake, Runner: fake}
+	assert.EqualError(t, Test(opts), "no such image: harbur/web:latest")
+}
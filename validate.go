@@ -0,0 +1,451 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	units "github.com/docker/go-units"
+	"github.com/harbur/captain/pkg/depgraph"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ValidationError reports an issue of captain.yml at a given position
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// ValidationErrors reports every issue found in captain.yml
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks the captain.yml at path: its syntax, unknown keys and
+// types, the apps referenced by wants, circular dependencies, the existence
+// of Dockerfiles, contexts and targets, and image references. Every issue is
+// reported with its position.
+func Validate(path string) error {
+	filename := configFile(path)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		pError(err.Error())
+		return StatusError{err, IOFailed}
+	}
+
+	errs := validateData(filename, data, true)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			pError(err.Error())
+		}
+		return StatusError{errs, InvalidCaptainYML}
+	}
+	pInfo("%s is valid", filename)
+	return nil
+}
+
+// validateData validates the content of captain.yml, once its variable
+// references are interpolated. The references between apps and the files
+// they use are only checked when complete is set.
+func validateData(filename string, data []byte, complete bool) ValidationErrors {
+	_, errs := parseData(filename, data, complete, false)
+	return errs
+}
+
+// parseData parses and validates the content of captain.yml, returning the
+// document with its variable references interpolated. With longSha,
+// CAPTAIN_REV is the long commit SHA.
+func parseData(filename string, data []byte, complete, longSha bool) (*yaml.Node, ValidationErrors) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, ValidationErrors{syntaxError(filename, err)}
+	}
+
+	v := validator{file: filename, longSha: longSha}
+	v.expand(&root, make(map[*yaml.Node]bool))
+	v.interpolate(&root)
+	apps := v.structure(&root)
+	if complete && len(v.errs) == 0 {
+		v.references(apps)
+		v.files(apps, filepath.Dir(filename))
+	}
+	return &root, v.errs
+}
+
+var lineRegexp = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// syntaxError converts a YAML syntax error to a ValidationError.
+func syntaxError(filename string, err error) ValidationError {
+	if m := lineRegexp.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return ValidationError{File: filename, Line: line, Message: m[2]}
+	}
+	return ValidationError{File: filename, Line: 1, Message: strings.TrimPrefix(err.Error(), "yaml: ")}
+}
+
+// appNode holds the nodes of an app of captain.yml
+type appNode struct {
+	name   string
+	key    *yaml.Node
+	fields map[string]*yaml.Node
+	app    App
+}
+
+type validator struct {
+	file    string
+	longSha bool
+	errs    ValidationErrors
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...interface{}) {
+	v.errs = append(v.errs, ValidationError{
+		File:    v.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// appFields returns the types of the App fields by YAML key.
+func appFields() map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	t := reflect.TypeOf(App{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = t.Field(i).Type
+		}
+	}
+	return fields
+}
+
+// expand replaces the aliases of the node with copies of their anchored
+// nodes, and the << merge keys of its mappings with the merged entries, so
+// that every app is validated, interpolated and decoded on its own.
+// Expanding holds the anchored nodes being expanded, to detect recursive
+// aliases.
+func (v *validator) expand(node *yaml.Node, expanding map[*yaml.Node]bool) {
+	for i, child := range node.Content {
+		if child.Kind == yaml.AliasNode {
+			if expanding[child.Alias] {
+				v.errorf(child, "recursive alias %s", child.Value)
+				node.Content[i] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Line: child.Line, Column: child.Column}
+				continue
+			}
+			anchor := child.Alias
+			expanding[anchor] = true
+			node.Content[i] = copyNode(anchor)
+			v.expand(node.Content[i], expanding)
+			delete(expanding, anchor)
+			continue
+		}
+		v.expand(child, expanding)
+	}
+	if node.Kind == yaml.MappingNode {
+		v.merge(node)
+	}
+}
+
+// merge replaces the << keys of the mapping with the entries of the merged
+// mappings. The keys of the mapping take precedence, then the ones of the
+// first merged mappings.
+func (v *validator) merge(node *yaml.Node) {
+	var own, merged []*yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Kind != yaml.ScalarNode || key.Value != "<<" || key.Tag != "!!merge" {
+			own = append(own, key, value)
+			continue
+		}
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+		for _, source := range sources {
+			if source.Kind != yaml.MappingNode {
+				v.errorf(source, "merged value must be a mapping")
+				continue
+			}
+			merged = append(merged, source.Content...)
+		}
+	}
+	if len(own) == len(node.Content) {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(own); i += 2 {
+		seen[own[i].Value] = true
+	}
+	for i := 0; i+1 < len(merged); i += 2 {
+		if !seen[merged[i].Value] {
+			seen[merged[i].Value] = true
+			own = append(own, merged[i], copyNode(merged[i+1]))
+		}
+	}
+	node.Content = own
+}
+
+// copyNode returns a deep copy of the node, so that it can be interpolated
+// independently of the original.
+func copyNode(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.Anchor = ""
+	c.Content = nil
+	for _, child := range node.Content {
+		c.Content = append(c.Content, copyNode(child))
+	}
+	return &c
+}
+
+// structure checks that every app is a mapping of known keys with values of
+// the expected type, and returns the apps in declaration order.
+func (v *validator) structure(root *yaml.Node) []appNode {
+	if root.Kind == 0 || len(root.Content) == 0 {
+		return nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		v.errorf(doc, "captain.yml must be a mapping of apps")
+		return nil
+	}
+
+	fields := appFields()
+	var apps []appNode
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, value := doc.Content[i], doc.Content[i+1]
+		if value.Kind != yaml.MappingNode {
+			v.errorf(value, "app %s must be a mapping", key.Value)
+			continue
+		}
+
+		app := appNode{name: key.Value, key: key, fields: make(map[string]*yaml.Node)}
+		valid := true
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			field, fieldValue := value.Content[j], value.Content[j+1]
+			t, ok := fields[field.Value]
+			if !ok {
+				valid = false
+				if suggestion := suggest(field.Value, fields); suggestion != "" {
+					v.errorf(field, "unknown key %q in app %s, did you mean %q?", field.Value, key.Value, suggestion)
+				} else {
+					v.errorf(field, "unknown key %q in app %s", field.Value, key.Value)
+				}
+				continue
+			}
+			if err := fieldValue.Decode(reflect.New(t).Interface()); err != nil {
+				valid = false
+				if nerr, ok := err.(*nodeError); ok {
+					v.errorf(nerr.node, "app %s: %s", key.Value, nerr.message)
+					continue
+				}
+				v.errorf(fieldValue, "invalid %s of app %s: expected %s", field.Value, key.Value, typeName(t))
+				continue
+			}
+			app.fields[field.Value] = fieldValue
+		}
+
+		if valid {
+			if err := value.Decode(&app.app); err != nil {
+				v.errorf(value, "invalid app %s: %s", key.Value, err)
+				continue
+			}
+			app.app.Name = key.Value
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+// references checks the images, the wants of the apps and their circular
+// dependencies.
+func (v *validator) references(apps []appNode) {
+	names := make(map[string]bool)
+	for _, app := range apps {
+		names[app.name] = true
+	}
+
+	var graph depgraph.Graph
+	dangling := false
+	for _, app := range apps {
+		if node, ok := app.fields["image"]; !ok || app.app.Image == "" {
+			v.errorf(app.key, "missing image of app %s", app.name)
+		} else if !validImageName(app.app.Image) {
+			v.errorf(node, "invalid image reference %q of app %s", app.app.Image, app.name)
+		}
+
+		if node, ok := app.fields["backend"]; ok {
+			switch app.app.Backend {
+			case BackendDocker, BackendBuildkit, BackendBuildx:
+			default:
+				v.errorf(node, "unknown backend %q of app %s", app.app.Backend, app.name)
+			}
+		}
+
+		if node, ok := app.fields["max_context_size"]; ok {
+			if _, err := units.FromHumanSize(app.app.Max_context_size); err != nil {
+				v.errorf(node, "invalid max_context_size %q of app %s, expected a size such as 500MB", app.app.Max_context_size, app.name)
+			}
+		}
+
+		for i, tag := range app.app.Tags {
+			if _, err := template.New("tag").Parse(tag); err != nil {
+				v.errorf(app.fields["tags"].Content[i], "invalid tag template %q of app %s: %s", tag, app.name, err)
+			}
+		}
+
+		for i, want := range app.app.Wants {
+			if !names[want] {
+				dangling = true
+				v.errorf(app.fields["wants"].Content[i], "app %s wants unknown app %s", app.name, want)
+			}
+		}
+		graph = append(graph, depgraph.NewNode(app.name, app.app.Wants...))
+	}
+
+	// Dangling wants also prevent the resolution, they are already reported
+	_, err := depgraph.ResolveGraph(graph)
+	cycle, ok := err.(*depgraph.CycleError)
+	if !ok || dangling {
+		return
+	}
+	for _, app := range apps {
+		if app.name == cycle.Path[0] {
+			v.errorf(app.key, "%s", cycle.Error())
+			return
+		}
+	}
+}
+
+// files checks the contexts, Dockerfiles and targets of the apps, relative
+// to the directory of captain.yml.
+func (v *validator) files(apps []appNode, dir string) {
+	for _, app := range apps {
+		contextNode, ok := app.fields["context"]
+		if !ok {
+			contextNode = app.key
+		}
+		buildNode, ok := app.fields["build"]
+		if !ok {
+			buildNode = app.key
+		}
+
+		contextDir := filepath.Join(dir, app.app.Context)
+		if info, err := os.Stat(contextDir); err != nil || !info.IsDir() {
+			v.errorf(contextNode, "context %s of app %s is not a directory", app.app.Context, app.name)
+			continue
+		}
+
+		dockerfile := filepath.Join(contextDir, app.app.Build)
+		if info, err := os.Stat(dockerfile); err != nil || info.IsDir() {
+			v.errorf(buildNode, "Dockerfile %s of app %s not found", app.app.Build, app.name)
+			continue
+		}
+
+		if node, ok := app.fields["target"]; ok {
+			if found, err := hasStage(dockerfile, app.app.Target); err == nil && !found {
+				v.errorf(node, "target stage %s of app %s not found in %s", app.app.Target, app.name, app.app.Build)
+			}
+		}
+	}
+}
+
+// imageNameRegexp matches repository names of the Docker reference grammar,
+// with an optional registry host and without tag nor digest.
+var imageNameRegexp = regexp.MustCompile(`^` +
+	`(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*` +
+	`(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`$`)
+
+// validImageName reports whether the image is a valid repository name. Tags
+// are managed by captain and not allowed.
+func validImageName(image string) bool {
+	if len(image) > 255 || !imageNameRegexp.MatchString(image) {
+		return false
+	}
+	// Like Docker, the first component is only a registry host when it
+	// contains a dot or a port, or is localhost.
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return true
+	}
+	host := image[:i]
+	return strings.ContainsAny(host, ".:") || host == "localhost" || host == strings.ToLower(host)
+}
+
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice:
+		return "a list"
+	case reflect.Map:
+		return "a mapping"
+	}
+	return "a " + t.Kind().String()
+}
+
+// suggest returns the known key closest to the unknown one, if close enough
+// to be a typo.
+func suggest(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for field := range fields {
+		if d := levenshtein(key, field); d < bestDistance || (d == bestDistance && field < best) {
+			best, bestDistance = field, d
+		}
+	}
+	if bestDistance > 2 {
+		return ""
+	}
+	return best
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,222 @@
+package captain // import "github.com/harbur/captain"
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// validateSimple validates the data as if it was the captain.yml of test/Simple
+func validateSimple(data string) ValidationErrors {
+	return validateData(basedir+"/test/Simple/captain.yml", []byte(data), true)
+}
+
+func TestValidateValid(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+backend:
+  build: Dockerfile.backend
+  image: localhost:5000/harbur/test_backend
+  wants:
+    - web
+`)
+	assert.Empty(t, errs)
+}
+
+func TestValidateSyntax(t *testing.T) {
+	errs := validateSimple("web:\n  build: Dockerfile\n image: harbur/test_web\n")
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 2, errs[0].Line)
+	assert.Equal(t, "did not find expected key", errs[0].Message)
+}
+
+func TestValidateUnknownKey(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+  biuld_arg:
+    key: value
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, ValidationError{
+		File:    basedir + "/test/Simple/captain.yml",
+		Line:    5,
+		Column:  3,
+		Message: `unknown key "biuld_arg" in app web, did you mean "build_arg"?`,
+	}, errs[0])
+}
+
+func TestValidateInvalidType(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+  test: echo testing
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 5, errs[0].Line)
+	assert.Equal(t, 9, errs[0].Column)
+	assert.Equal(t, "invalid test of app web: expected a list", errs[0].Message)
+}
+
+func TestValidateWants(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+  wants:
+    - nonexistent
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 6, errs[0].Line)
+	assert.Equal(t, "app web wants unknown app nonexistent", errs[0].Message)
+}
+
+func TestValidateCircular(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+  wants: [backend]
+backend:
+  build: Dockerfile.backend
+  image: harbur/test_backend
+  wants: [web]
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 2, errs[0].Line)
+	assert.Equal(t, "circular dependency: web -> backend -> web", errs[0].Message)
+}
+
+func TestValidateFiles(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile.nonexistent
+  image: harbur/test_web
+backend:
+  context: nonexistent
+  image: harbur/test_backend
+`)
+	assert.Equal(t, 2, len(errs))
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Equal(t, "Dockerfile Dockerfile.nonexistent of app web not found", errs[0].Message)
+	assert.Equal(t, 6, errs[1].Line)
+	assert.Equal(t, "context nonexistent of app backend is not a directory", errs[1].Message)
+}
+
+func TestValidateImage(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: Harbur/Test_Web
+backend:
+  build: Dockerfile.backend
+`)
+	assert.Equal(t, 2, len(errs))
+	assert.Equal(t, `invalid image reference "Harbur/Test_Web" of app web`, errs[0].Message)
+	assert.Equal(t, "missing image of app backend", errs[1].Message)
+}
+
+func TestValidImageName(t *testing.T) {
+	assert.True(t, validImageName("alpine"))
+	assert.True(t, validImageName("harbur/captain"))
+	assert.True(t, validImageName("quay.io/harbur/captain"))
+	assert.True(t, validImageName("localhost:5000/my_app.v2-beta"))
+	assert.False(t, validImageName("harbur/captain:latest"))
+	assert.False(t, validImageName("Harbur/captain"))
+	assert.False(t, validImageName("harbur//captain"))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(basedir+"/test/Simple/captain.yml"))
+	assert.NoError(t, Validate(basedir+"/test/Stages/captain.yml"))
+}
+
+func TestReadConfigUnknownKey(t *testing.T) {
+	_, err := unmarshal("captain.yml", []byte("web:\n  image: harbur/test_web\n  biuld: Dockerfile\n"), false)
+	assert.Error(t, err)
+	assert.Equal(t, InvalidCaptainYML, err.(StatusError).Status())
+	assert.Contains(t, err.Error(), "captain.yml:3:3")
+}
+
+func TestValidateMaxContextSize(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+  max_context_size: 500MB
+backend:
+  build: Dockerfile.backend
+  image: harbur/test_backend
+  max_context_size: large
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 9, errs[0].Line)
+	assert.Equal(t, `invalid max_context_size "large" of app backend, expected a size such as 500MB`, errs[0].Message)
+}
+
+func TestValidateTags(t *testing.T) {
+	errs := validateSimple(`
+web:
+  build: Dockerfile
+  image: harbur/test_web
+  tags:
+    - stable
+    - "{{.Branch"
+`)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, 7, errs[0].Line)
+	assert.Contains(t, errs[0].Message, `invalid tag template "{{.Branch" of app web`)
+}
+
+func TestValidateMergeKey(t *testing.T) {
+	data := `
+web: &base
+  build: Dockerfile
+  image: harbur/test_web
+  pre: [echo web]
+backend:
+  <<: *base
+  image: harbur/test_backend
+`
+	assert.Empty(t, validateSimple(data))
+
+	c, err := unmarshal("captain.yml", []byte(data), false)
+	assert.NoError(t, err)
+	backend := c.Apps["backend"]
+	assert.Equal(t, "Dockerfile", backend.Build)
+	assert.Equal(t, "harbur/test_backend", backend.Image)
+	assert.Equal(t, []string{"echo web"}, backend.Pre)
+
+	errs := validateSimple("web: &base\n  image: harbur/test_web\nbackend:\n  <<: *base\n  biuld: Dockerfile\n")
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, `unknown key "biuld" in app backend, did you mean "build"?`, errs[0].Message)
+	}
+	errs = validateSimple("web:\n  image: harbur/test_web\nbackend:\n  <<: [1]\n  image: harbur/test_backend\n")
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "merged value must be a mapping", errs[0].Message)
+	}
+}
+
+func TestValidateAlias(t *testing.T) {
+	data := `
+web: &base
+  build: Dockerfile
+  image: harbur/test_web
+backend: *base
+`
+	assert.Empty(t, validateSimple(data))
+
+	c, err := unmarshal("captain.yml", []byte(data), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "harbur/test_web", c.Apps["backend"].Image)
+	assert.Equal(t, "Dockerfile", c.Apps["backend"].Build)
+
+	errs := validateSimple("web: &base\n  image: harbur/test_web\n  pre: [*base]\n")
+	if assert.NotEmpty(t, errs) {
+		assert.Equal(t, "recursive alias base", errs[0].Message)
+	}
+}